@@ -3,8 +3,9 @@ module github.com/bifshteks/tough_common
 go 1.16
 
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/stretchr/testify v1.7.1 // indirect
-	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29 // indirect
+	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.15.1
+	github.com/sirupsen/logrus v1.8.1
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
 )
@@ -0,0 +1,160 @@
+package ssh
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNoAgent is returned by ConnectAgent when SSH_AUTH_SOCK is not set
+var ErrNoAgent = errors.New("SSH_AUTH_SOCK is not set, ssh-agent is not running")
+
+// ErrKeyNotInAgent is returned by Agent.Signer for keys the agent does not have
+var ErrKeyNotInAgent = errors.New("key is not in the agent")
+
+// Agent is an ssh-agent: the user's one, connected over its socket, or one
+// keeping keys in memory. Keys added to an agent cannot be read back, only
+// listed and used to sign, so services never see the user's private keys.
+type Agent struct {
+	agent.ExtendedAgent
+	conn net.Conn // nil for in-memory agents
+}
+
+// ConnectAgent connects to the agent of SSH_AUTH_SOCK
+func ConnectAgent() (*Agent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, ErrNoAgent
+	}
+	return ConnectAgentAt(socket)
+}
+
+// ConnectAgentAt connects to the agent listening on the unix socket
+func ConnectAgentAt(socket string) (*Agent, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ssh-agent at %s: %w", socket, err)
+	}
+	return &Agent{ExtendedAgent: agent.NewClient(conn), conn: conn}, nil
+}
+
+// NewMemoryAgent returns an agent keeping keys in memory, e.g. for tests or
+// to forward keys to remote hosts without adding them to the user's agent
+func NewMemoryAgent() *Agent {
+	return &Agent{ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent)}
+}
+
+type AgentKeyOptions struct {
+	Comment string
+	// Lifetime makes the agent forget the key after it, which is rounded up to
+	// seconds. Keys are kept until removed if it is 0.
+	Lifetime time.Duration
+	// ConfirmBeforeUse makes the agent ask the user (with ssh-askpass) every
+	// time the key is used. AddKey of in-memory agents fails with it.
+	ConfirmBeforeUse bool
+	// Certificate is added along with the key, it must be of its public key
+	Certificate *ssh.Certificate
+}
+
+// AddKey adds the private key, e.g. KeyPair.PrivateKey or one parsed with ParseRawPrivateKey
+func (a *Agent) AddKey(key crypto.Signer, options AgentKeyOptions) error {
+	if options.Lifetime < 0 {
+		return errors.New("key lifetime cannot be negative")
+	}
+	if options.ConfirmBeforeUse && a.conn == nil {
+		// the keyring would ignore it and sign without asking
+		return errors.New("in-memory agent cannot confirm use of keys")
+	}
+	return a.Add(agent.AddedKey{
+		PrivateKey:       key,
+		Certificate:      options.Certificate,
+		Comment:          options.Comment,
+		LifetimeSecs:     uint32((options.Lifetime + time.Second - 1) / time.Second),
+		ConfirmBeforeUse: options.ConfirmBeforeUse,
+	})
+}
+
+// Signer returns the signer of the agent for the public key, e.g. for NewCA
+// with the CA key kept in the agent
+func (a *Agent) Signer(key ssh.PublicKey) (ssh.Signer, error) {
+	signers, err := a.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		if sameKey(signer.PublicKey(), key) {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %s", ErrKeyNotInAgent, key.Type(), FingerprintSHA256(key))
+}
+
+// AuthMethod authenticates with the keys of the agent, as listed on every
+// connection, e.g. for source.SSHOptions.Auth
+func (a *Agent) AuthMethod() ssh.AuthMethod {
+	return ssh.PublicKeysCallback(a.Signers)
+}
+
+// Serve serves the agent on the listener (usually a unix socket to be set as
+// SSH_AUTH_SOCK of other processes) until ctx is done or the listener fails.
+// The connections it served are closed before it returns.
+func (a *Agent) Serve(ctx context.Context, listener net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var served sync.WaitGroup
+	defer served.Wait()
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		served.Add(1)
+		go func() {
+			defer served.Done()
+			defer conn.Close()
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-stop:
+				}
+			}()
+			_ = agent.ServeAgent(a.ExtendedAgent, conn)
+		}()
+	}
+}
+
+// Forward forwards the agent to the remote host of the session, as ssh -A.
+// Processes of the session can then use the keys of the agent, so forward only
+// to trusted hosts, ideally an in-memory agent with just the keys they need.
+// The client can forward one agent only.
+func (a *Agent) Forward(client *ssh.Client, session *ssh.Session) error {
+	if err := agent.ForwardToAgent(client, a.ExtendedAgent); err != nil {
+		return err
+	}
+	return agent.RequestAgentForwarding(session)
+}
+
+// Close closes the connection to the agent, it does nothing for in-memory agents
+func (a *Agent) Close() error {
+	if a.conn == nil {
+		return nil
+	}
+	return a.conn.Close()
+}
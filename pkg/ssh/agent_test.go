@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveMemoryAgent serves an in-memory agent on a socket set as SSH_AUTH_SOCK
+func serveMemoryAgent(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go NewMemoryAgent().Serve(ctx, listener)
+	previous, set := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SSH_AUTH_SOCK", previous)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	})
+}
+
+func TestAgent(t *testing.T) {
+	serveMemoryAgent(t)
+	a, err := ConnectAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddKey(pair.PrivateKey, AgentKeyOptions{Comment: "tunnel"}); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "tunnel" || !sameKey(keys[0], pair.PublicKey) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	signer, err := a.Signer(pair.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("challenge")
+	signature, err := signer.Sign(nil, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair.PublicKey.Verify(data, signature); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := GenerateKey(KeyOptions{Algorithm: ECDSAP256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Signer(other.PublicKey); !errors.Is(err, ErrKeyNotInAgent) {
+		t.Fatalf("expected ErrKeyNotInAgent, got %v", err)
+	}
+	if err := a.Remove(pair.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := a.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("key not removed: %v %v", keys, err)
+	}
+}
+
+func TestAgentKeyLifetime(t *testing.T) {
+	serveMemoryAgent(t)
+	a, err := ConnectAgent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rounded up to a second rather than down to no lifetime at all
+	if err := a.AddKey(pair.PrivateKey, AgentKeyOptions{Lifetime: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := a.List(); err != nil || len(keys) != 1 {
+		t.Fatalf("key not added: %v %v", keys, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if keys, err := a.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("key not expired: %v %v", keys, err)
+	}
+}
+
+func TestConnectAgentWithoutSocket(t *testing.T) {
+	previous, set := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	if set {
+		defer os.Setenv("SSH_AUTH_SOCK", previous)
+	}
+	if _, err := ConnectAgent(); !errors.Is(err, ErrNoAgent) {
+		t.Fatalf("expected ErrNoAgent, got %v", err)
+	}
+}
+
+func TestMemoryAgentRefusesConfirmBeforeUse(t *testing.T) {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewMemoryAgent()
+	if err := a.AddKey(pair.PrivateKey, AgentKeyOptions{ConfirmBeforeUse: true}); err == nil {
+		t.Fatal("key added without confirmation")
+	}
+	if keys, _ := a.List(); len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestAgentServeClosesConnections(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- NewMemoryAgent().Serve(ctx, listener) }()
+	a, err := ConnectAgentAt(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if _, err := a.List(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return")
+	}
+	if _, err := a.List(); err == nil {
+		t.Fatal("connection is still served")
+	}
+}
@@ -0,0 +1,164 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// authorizedKeysLine is a line of authorized_keys, key is nil for comments,
+// empty lines and lines that cannot be parsed, which are kept as they are
+type authorizedKeysLine struct {
+	text string
+	key  *AuthorizedKey
+}
+
+// ErrUnsafeDir is returned when the directory of authorized_keys is writable
+// by others than its owner
+var ErrUnsafeDir = errors.New("directory is writable by others")
+
+// AuthorizedKeysFile is an authorized_keys file loaded to be edited. Comments
+// and lines that cannot be parsed are kept in place, keys keep their options
+// (from=, command= etc.) and comments. Nothing is written until Save.
+type AuthorizedKeysFile struct {
+	path  string
+	lines []authorizedKeysLine
+}
+
+// LoadAuthorizedKeys reads the file, which does not need to exist
+func LoadAuthorizedKeys(path string) (*AuthorizedKeysFile, error) {
+	file := &AuthorizedKeysFile{path: path}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // lines with rsa keys and options are long
+	for scanner.Scan() {
+		text := scanner.Text()
+		line := authorizedKeysLine{text: text}
+		trimmed := strings.TrimSpace(text)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if key, err := ParseAuthorizedKey(trimmed); err == nil {
+				line.key = key
+			}
+		}
+		file.lines = append(file.lines, line)
+	}
+	return file, scanner.Err()
+}
+
+func (file *AuthorizedKeysFile) Path() string {
+	return file.path
+}
+
+// Keys returns the keys in the order of the file
+func (file *AuthorizedKeysFile) Keys() []AuthorizedKey {
+	keys := make([]AuthorizedKey, 0, len(file.lines))
+	for _, line := range file.lines {
+		if line.key != nil {
+			keys = append(keys, *line.key)
+		}
+	}
+	return keys
+}
+
+// Contains tells whether the key (with any options) is in the file
+func (file *AuthorizedKeysFile) Contains(key ssh.PublicKey) bool {
+	for _, line := range file.lines {
+		if line.key != nil && sameKey(line.key.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends the key unless it is already in the file, keeping the existing
+// line then. Returns whether the key was added.
+func (file *AuthorizedKeysFile) Add(key AuthorizedKey) bool {
+	if file.Contains(key.Key) {
+		return false
+	}
+	file.lines = append(file.lines, authorizedKeysLine{text: key.String(), key: &key})
+	return true
+}
+
+// AddLine parses the authorized_keys line (e.g. KeyPair.AuthorizedKey) and adds it
+func (file *AuthorizedKeysFile) AddLine(line string) (bool, error) {
+	key, err := ParseAuthorizedKey(line)
+	if err != nil {
+		return false, err
+	}
+	return file.Add(*key), nil
+}
+
+// Remove removes all lines with the key, returning how many were removed
+func (file *AuthorizedKeysFile) Remove(key ssh.PublicKey) int {
+	return file.RemoveFunc(func(authorized AuthorizedKey) bool {
+		return sameKey(authorized.Key, key)
+	})
+}
+
+// RemoveFunc removes the keys for which remove returns true, returning how many were removed
+func (file *AuthorizedKeysFile) RemoveFunc(remove func(key AuthorizedKey) bool) int {
+	kept := file.lines[:0]
+	removed := 0
+	for _, line := range file.lines {
+		if line.key != nil && remove(*line.key) {
+			removed++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	file.lines = kept
+	return removed
+}
+
+// Deduplicate removes repeated keys, keeping the first line of each, which is
+// the one sshd uses. Returns how many lines were removed.
+func (file *AuthorizedKeysFile) Deduplicate() int {
+	seen := make(map[string]bool)
+	return file.RemoveFunc(func(key AuthorizedKey) bool {
+		marshaled := string(key.Key.Marshal())
+		duplicate := seen[marshaled]
+		seen[marshaled] = true
+		return duplicate
+	})
+}
+
+// Save atomically replaces the file with the edited content. The file gets
+// mode 0600 and its directory 0700 if it has to be created. Save fails with
+// ErrUnsafeDir if the existing directory is writable by others, as sshd with
+// StrictModes ignores files others can change.
+func (file *AuthorizedKeysFile) Save() error {
+	dir := filepath.Dir(file.path)
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case info.Mode().Perm()&0022 != 0:
+		return fmt.Errorf("%w: %s has mode %o", ErrUnsafeDir, dir, info.Mode().Perm())
+	}
+	var content bytes.Buffer
+	for _, line := range file.lines {
+		content.WriteString(line.text + "\n")
+	}
+	return writeFileAtomic(file.path, content.Bytes(), 0600)
+}
+
+func sameKey(a ssh.PublicKey, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".ssh", "authorized_keys")
+	first, _ := GenerateKey(KeyOptions{Comment: "first"})
+	second, _ := GenerateKey(KeyOptions{Comment: "second"})
+	file, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Keys()) != 0 {
+		t.Fatal("missing file has keys")
+	}
+	restricted := `from="10.0.0.0/8",command="tunnel" ` + first.AuthorizedKey
+	if added, err := file.AddLine(restricted); !added || err != nil {
+		t.Fatalf("added %v, err %v", added, err)
+	}
+	if added, _ := file.AddLine(first.AuthorizedKey); added {
+		t.Fatal("key added twice")
+	}
+	if _, err := file.AddLine("not a key"); err == nil {
+		t.Fatal("invalid line added")
+	}
+	file.AddLine(second.AuthorizedKey)
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("authorized_keys has mode %o", info.Mode().Perm())
+	}
+	dirInfo, _ := os.Stat(filepath.Dir(path))
+	if dirInfo.Mode().Perm() != 0700 {
+		t.Fatalf(".ssh has mode %o", dirInfo.Mode().Perm())
+	}
+	content, _ := ioutil.ReadFile(path)
+	if string(content) != restricted+"\n"+second.AuthorizedKey+"\n" {
+		t.Fatalf("unexpected content:\n%s", content)
+	}
+
+	reloaded, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := reloaded.Keys()
+	if len(keys) != 2 || keys[0].Options[1] != `command="tunnel"` || keys[1].Comment != "second" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	if removed := reloaded.Remove(first.PublicKey); removed != 1 || reloaded.Contains(first.PublicKey) {
+		t.Fatalf("removed %d keys", removed)
+	}
+}
+
+func TestAuthorizedKeysFileRefusesUnsafeDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".ssh")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Mkdir is subject to umask, Chmod is not
+	if err := os.Chmod(dir, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	file, err := LoadAuthorizedKeys(filepath.Join(dir, "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, _ := GenerateKey(KeyOptions{})
+	file.AddLine(pair.AuthorizedKey)
+	if err := file.Save(); !errors.Is(err, ErrUnsafeDir) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	info, _ := os.Stat(dir)
+	if info.Mode() != os.ModeDir|0777|os.ModeSticky {
+		t.Fatalf("mode of the directory changed to %s", info.Mode())
+	}
+}
+
+func TestAuthorizedKeysFileKeepsCommentsAndDeduplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	key, _ := GenerateKey(KeyOptions{})
+	other, _ := GenerateKey(KeyOptions{})
+	original := strings.Join([]string{
+		"# managed by hand",
+		key.AuthorizedKey + " laptop",
+		"",
+		"garbage that sshd ignores",
+		"no-pty " + key.AuthorizedKey + " copy",
+		other.AuthorizedKey,
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := LoadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed := file.Deduplicate(); removed != 1 {
+		t.Fatalf("removed %d duplicates", removed)
+	}
+	if err := file.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(path)
+	expected := strings.Replace(original, "no-pty "+key.AuthorizedKey+" copy\n", "", 1)
+	if string(content) != expected {
+		t.Fatalf("unexpected content:\n%s", content)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("authorized_keys has mode %o", info.Mode().Perm())
+	}
+}
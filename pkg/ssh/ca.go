@@ -0,0 +1,251 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultCertValidity is how long certificates are valid when CertOptions.ValidBefore is not set
+const DefaultCertValidity = 24 * time.Hour
+
+// DefaultUserExtensions returns the permissions of user certificates when
+// CertOptions.Extensions is nil, the same as ssh-keygen grants by default
+func DefaultUserExtensions() map[string]string {
+	return map[string]string{
+		"permit-X11-forwarding":   "",
+		"permit-agent-forwarding": "",
+		"permit-port-forwarding":  "",
+		"permit-pty":              "",
+		"permit-user-rc":          "",
+	}
+}
+
+type CertOptions struct {
+	// KeyID identifies the certificate in logs of the servers
+	KeyID string
+	// Principals are user names (for user certificates) or host names (for host
+	// certificates) the certificate is valid for. Empty means any host for host
+	// certificates, user certificates require at least one (SignUserCert fails
+	// and CertVerifier rejects them otherwise).
+	Principals []string
+	// ValidAfter is the start of validity, now if zero
+	ValidAfter time.Time
+	// ValidBefore is the end of validity, ValidAfter + DefaultCertValidity if zero
+	ValidBefore time.Time
+	// CriticalOptions restrict user certificates, e.g. "force-command" or "source-address"
+	CriticalOptions map[string]string
+	// Extensions grant permissions to user certificates, DefaultUserExtensions if nil
+	Extensions map[string]string
+	// Serial identifies the certificate for revocation, random if 0
+	Serial uint64
+}
+
+// CA signs user and host certificates with its key
+type CA struct {
+	signer ssh.Signer
+	// now is used for the default validity window
+	now func() time.Time
+}
+
+func NewCA(signer ssh.Signer) *CA {
+	return &CA{signer: signer, now: time.Now}
+}
+
+// PublicKey is the key to trust certificates of the CA with
+func (ca *CA) PublicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+// AuthorizedKey returns the line of authorized_keys that trusts user certificates of the CA
+func (ca *CA) AuthorizedKey() string {
+	return AuthorizedKey{Options: []string{"cert-authority"}, Key: ca.PublicKey()}.String()
+}
+
+// ErrNoPrincipals is returned for user certificates without principals, which
+// ssh.CertChecker would accept for any user
+var ErrNoPrincipals = errors.New("user certificate has no principals")
+
+// SignUserCert issues a certificate for the user key, valid for options.Principals
+func (ca *CA) SignUserCert(key ssh.PublicKey, options CertOptions) (*ssh.Certificate, error) {
+	if len(options.Principals) == 0 {
+		return nil, ErrNoPrincipals
+	}
+	if options.Extensions == nil {
+		options.Extensions = DefaultUserExtensions()
+	}
+	return ca.sign(key, ssh.UserCert, options)
+}
+
+// SignHostCert issues a certificate for the host key. Critical options and
+// extensions are not defined for host certificates, so they are ignored.
+func (ca *CA) SignHostCert(key ssh.PublicKey, options CertOptions) (*ssh.Certificate, error) {
+	options.CriticalOptions = nil
+	options.Extensions = nil
+	return ca.sign(key, ssh.HostCert, options)
+}
+
+func (ca *CA) sign(key ssh.PublicKey, certType uint32, options CertOptions) (*ssh.Certificate, error) {
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("cannot sign a certificate, sign its key instead")
+	}
+	validAfter := options.ValidAfter
+	if validAfter.IsZero() {
+		validAfter = ca.now()
+	}
+	validBefore := options.ValidBefore
+	if validBefore.IsZero() {
+		validBefore = validAfter.Add(DefaultCertValidity)
+	}
+	if !validBefore.After(validAfter) {
+		return nil, fmt.Errorf("certificate validity ends (%s) before it starts (%s)", validBefore, validAfter)
+	}
+	serial := options.Serial
+	if serial == 0 {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		serial = binary.BigEndian.Uint64(random)
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        certType,
+		KeyId:           options.KeyID,
+		ValidPrincipals: options.Principals,
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: options.CriticalOptions,
+			Extensions:      options.Extensions,
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// RevocationList holds certificates that must not be accepted any more
+// even though they are still valid
+type RevocationList struct {
+	mx      sync.RWMutex
+	serials map[uint64]bool
+	keys    map[string]bool
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		serials: make(map[uint64]bool),
+		keys:    make(map[string]bool),
+	}
+}
+
+// RevokeSerial revokes the certificate with the serial
+func (list *RevocationList) RevokeSerial(serial uint64) {
+	list.mx.Lock()
+	defer list.mx.Unlock()
+	list.serials[serial] = true
+}
+
+// RevokeKey revokes all certificates of the key
+func (list *RevocationList) RevokeKey(key ssh.PublicKey) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	list.mx.Lock()
+	defer list.mx.Unlock()
+	list.keys[FingerprintSHA256(key)] = true
+}
+
+func (list *RevocationList) IsRevoked(cert *ssh.Certificate) bool {
+	list.mx.RLock()
+	defer list.mx.RUnlock()
+	return list.serials[cert.Serial] || list.keys[FingerprintSHA256(cert.Key)]
+}
+
+// CertVerifier checks certificates against trusted CAs, so that servers can
+// authenticate users and clients can authenticate hosts by certificates
+type CertVerifier struct {
+	UserAuthorities []ssh.PublicKey
+	HostAuthorities []ssh.PublicKey
+	// SupportedCriticalOptions are the critical options the application enforces
+	// (e.g. "force-command"), certificates with any other are rejected
+	SupportedCriticalOptions []string
+	// Revoked may be nil
+	Revoked *RevocationList
+	// Clock is used to check validity of certificates, time.Now if nil
+	Clock func() time.Time
+}
+
+func (verifier CertVerifier) checker() *ssh.CertChecker {
+	return &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return containsKey(verifier.UserAuthorities, auth)
+		},
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return containsKey(verifier.HostAuthorities, auth)
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return verifier.Revoked != nil && verifier.Revoked.IsRevoked(cert)
+		},
+		SupportedCriticalOptions: verifier.SupportedCriticalOptions,
+		Clock:                    verifier.Clock,
+	}
+}
+
+// Verify checks that the certificate is of certType (ssh.UserCert or ssh.HostCert),
+// signed by a trusted CA, valid now for the principal and not revoked
+func (verifier CertVerifier) Verify(cert *ssh.Certificate, certType uint32, principal string) error {
+	authorities := verifier.UserAuthorities
+	if certType == ssh.HostCert {
+		authorities = verifier.HostAuthorities
+	}
+	if cert.CertType != certType {
+		return fmt.Errorf("certificate of type %d where %d expected", cert.CertType, certType)
+	}
+	if !containsKey(authorities, cert.SignatureKey) {
+		return fmt.Errorf("certificate %q is signed by unknown authority %s", cert.KeyId, FingerprintSHA256(cert.SignatureKey))
+	}
+	if certType == ssh.UserCert && len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("certificate %q: %w", cert.KeyId, ErrNoPrincipals)
+	}
+	return verifier.checker().CheckCert(principal, cert)
+}
+
+// UserCallback is ssh.ServerConfig.PublicKeyCallback accepting user certificates
+// valid for the user name of the connection
+func (verifier CertVerifier) UserCallback() func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	checker := verifier.checker()
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if cert, ok := key.(*ssh.Certificate); ok && cert.CertType == ssh.UserCert && len(cert.ValidPrincipals) == 0 {
+			return nil, fmt.Errorf("certificate %q: %w", cert.KeyId, ErrNoPrincipals)
+		}
+		return checker.Authenticate(conn, key)
+	}
+}
+
+// HostKeyCallback is ssh.ClientConfig.HostKeyCallback accepting host certificates
+// valid for the host name dialed
+func (verifier CertVerifier) HostKeyCallback() ssh.HostKeyCallback {
+	checker := verifier.checker()
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return checker.CheckHostKey(hostname, remote, key)
+	}
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
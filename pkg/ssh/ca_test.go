@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) *CA {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCA(signer)
+}
+
+func newCertSigner(t *testing.T, sign func(key ssh.PublicKey) (*ssh.Certificate, error)) (ssh.Signer, *ssh.Certificate) {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := sign(pair.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(pair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certSigner, cert
+}
+
+func TestCAVerify(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Unix(1700000000, 0)
+	ca.now = func() time.Time { return now }
+	_, cert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignUserCert(key, CertOptions{
+			KeyID:           "alice@laptop",
+			Principals:      []string{"alice"},
+			CriticalOptions: map[string]string{"force-command": "tunnel"},
+		})
+	})
+	if cert.Permissions.Extensions["permit-port-forwarding"] != "" || len(cert.Permissions.Extensions) == 0 {
+		t.Fatalf("unexpected extensions %v", cert.Permissions.Extensions)
+	}
+	revoked := NewRevocationList()
+	verifier := CertVerifier{
+		UserAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		Revoked:         revoked,
+		Clock:           func() time.Time { return now.Add(time.Hour) },
+	}
+	if err := verifier.Verify(cert, ssh.UserCert, "alice"); err == nil {
+		t.Fatal("certificate with unsupported critical option accepted")
+	}
+	verifier.SupportedCriticalOptions = []string{"force-command"}
+	if err := verifier.Verify(cert, ssh.UserCert, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.Verify(cert, ssh.UserCert, "bob"); err == nil {
+		t.Fatal("certificate accepted for another principal")
+	}
+	if err := verifier.Verify(cert, ssh.HostCert, "alice"); err == nil {
+		t.Fatal("user certificate accepted as host one")
+	}
+	if err := (CertVerifier{UserAuthorities: []ssh.PublicKey{newTestCA(t).PublicKey()}}).Verify(cert, ssh.UserCert, "alice"); err == nil {
+		t.Fatal("certificate of unknown CA accepted")
+	}
+
+	verifier.Clock = func() time.Time { return now.Add(DefaultCertValidity + time.Second) }
+	if err := verifier.Verify(cert, ssh.UserCert, "alice"); err == nil {
+		t.Fatal("expired certificate accepted")
+	}
+	verifier.Clock = func() time.Time { return now.Add(time.Hour) }
+	revoked.RevokeSerial(cert.Serial)
+	if err := verifier.Verify(cert, ssh.UserCert, "alice"); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+}
+
+func TestCACertificatesOnBothSidesOfConnection(t *testing.T) {
+	ca := newTestCA(t)
+	hostSigner, _ := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignHostCert(key, CertOptions{Principals: []string{"relay.example.com"}})
+	})
+	userSigner, userCert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignUserCert(key, CertOptions{Principals: []string{"alice"}})
+	})
+	revoked := NewRevocationList()
+	verifier := CertVerifier{
+		UserAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		HostAuthorities: []ssh.PublicKey{ca.PublicKey()},
+		Revoked:         revoked,
+	}
+	handshake := func(user string, host string) (clientErr error) {
+		serverConn, clientConn := tcpPipe(t)
+		defer serverConn.Close()
+		defer clientConn.Close()
+		serverConfig := &ssh.ServerConfig{PublicKeyCallback: verifier.UserCallback()}
+		serverConfig.AddHostKey(hostSigner)
+		go func() {
+			conn, _, _, err := ssh.NewServerConn(serverConn, serverConfig)
+			if err == nil {
+				conn.Close()
+			} else {
+				serverConn.Close()
+			}
+		}()
+		conn, _, _, err := ssh.NewClientConn(clientConn, host+":22", &ssh.ClientConfig{
+			User:              user,
+			Auth:              []ssh.AuthMethod{ssh.PublicKeys(userSigner)},
+			HostKeyCallback:   verifier.HostKeyCallback(),
+			HostKeyAlgorithms: []string{hostSigner.PublicKey().Type()},
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := handshake("alice", "relay.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake("alice", "evil.example.com"); err == nil {
+		t.Fatal("host certificate accepted for another host")
+	}
+	if err := handshake("bob", "relay.example.com"); err == nil {
+		t.Fatal("user certificate accepted for another user")
+	}
+	revoked.RevokeKey(userCert)
+	if err := handshake("alice", "relay.example.com"); err == nil {
+		t.Fatal("revoked user certificate accepted")
+	}
+}
+
+func TestCARefusesUserCertificatesWithoutPrincipals(t *testing.T) {
+	ca := newTestCA(t)
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.SignUserCert(pair.PublicKey, CertOptions{}); !errors.Is(err, ErrNoPrincipals) {
+		t.Fatalf("user certificate without principals signed: %v", err)
+	}
+
+	// signed by other tools, ssh.CertChecker alone would accept it for anyone
+	userSigner, cert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.sign(key, ssh.UserCert, CertOptions{})
+	})
+	verifier := CertVerifier{UserAuthorities: []ssh.PublicKey{ca.PublicKey()}}
+	if err := verifier.Verify(cert, ssh.UserCert, "alice"); !errors.Is(err, ErrNoPrincipals) {
+		t.Fatalf("user certificate without principals verified: %v", err)
+	}
+	if _, err := verifier.UserCallback()(connMetadata{user: "alice"}, userSigner.PublicKey()); !errors.Is(err, ErrNoPrincipals) {
+		t.Fatalf("user certificate without principals authenticated: %v", err)
+	}
+}
+
+// connMetadata is the part of ssh.ConnMetadata ssh.CertChecker uses
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (conn connMetadata) User() string {
+	return conn.user
+}
+
+// tcpPipe returns both ends of a local tcp connection. Unlike net.Pipe, its
+// writes do not block until the other end reads, as the ssh handshake needs.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
@@ -0,0 +1,143 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// ErrWeakKey is returned by KeyPolicy for keys it does not accept
+var ErrWeakKey = errors.New("key is too weak")
+
+// AuthorizedKey is a parsed line of authorized_keys:
+// [options] keytype base64-key [comment]
+type AuthorizedKey struct {
+	// Options are like `from="10.0.0.0/8"` or `no-pty`, in the order of the line
+	Options []string
+	Key     ssh.PublicKey
+	Comment string
+}
+
+// ParseAuthorizedKey parses a single line of authorized_keys
+func ParseAuthorizedKey(line string) (*AuthorizedKey, error) {
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(rest)) != 0 {
+		return nil, errors.New("more than one key in the line")
+	}
+	return &AuthorizedKey{Options: options, Key: key, Comment: comment}, nil
+}
+
+// String returns the key as a line of authorized_keys, without newline
+func (key AuthorizedKey) String() string {
+	line := authorizedKey(key.Key, key.Comment)
+	if len(key.Options) != 0 {
+		line = strings.Join(key.Options, ",") + " " + line
+	}
+	return line
+}
+
+// FingerprintSHA256 returns the fingerprint of the key as OpenSSH shows it by default,
+// "SHA256:" followed by unpadded base64
+func FingerprintSHA256(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// FingerprintMD5 returns the legacy fingerprint of the key as `ssh-keygen -E md5`
+// shows it, "MD5:" followed by colon separated hex
+func FingerprintMD5(key ssh.PublicKey) string {
+	return "MD5:" + ssh.FingerprintLegacyMD5(key)
+}
+
+// MatchesFingerprint tells whether the fingerprint (in either of the formats
+// above, MD5 with or without the prefix) is of the key
+func MatchesFingerprint(key ssh.PublicKey, fingerprint string) bool {
+	switch {
+	case strings.HasPrefix(fingerprint, "SHA256:"):
+		return fingerprint == FingerprintSHA256(key)
+	case strings.HasPrefix(fingerprint, "MD5:"):
+		return strings.EqualFold(fingerprint, FingerprintMD5(key))
+	}
+	return strings.EqualFold(fingerprint, ssh.FingerprintLegacyMD5(key))
+}
+
+// KeyPairMatches tells whether the public key (or the key of the certificate)
+// belongs to the private key
+func KeyPairMatches(privateKey crypto.Signer, publicKey ssh.PublicKey) bool {
+	own, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return false
+	}
+	if cert, ok := publicKey.(*ssh.Certificate); ok {
+		publicKey = cert.Key
+	}
+	return bytes.Equal(own.Marshal(), publicKey.Marshal())
+}
+
+// KeyPolicy is the minimum strength of keys accepted from users
+type KeyPolicy struct {
+	// MinRSABits is the smallest accepted RSA key, MinRSABits if 0
+	MinRSABits int
+	// MinECDSABits is the smallest accepted ECDSA curve, 256 if 0
+	MinECDSABits int
+	// AllowDSA accepts DSA keys, which are always 1024 bits and disabled in OpenSSH
+	AllowDSA bool
+	// Types, if not empty, are the only accepted key types (ssh.KeyAlgoED25519 etc.)
+	Types []string
+}
+
+// DefaultKeyPolicy rejects DSA and RSA keys shorter than 2048 bits
+var DefaultKeyPolicy = KeyPolicy{}
+
+// Check returns ErrWeakKey (wrapped with the reason) if the key is not accepted.
+// Certificates are checked by the key they certify.
+func (policy KeyPolicy) Check(key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	if len(policy.Types) != 0 && !contains(policy.Types, key.Type()) {
+		return fmt.Errorf("%w: %s keys are not accepted", ErrWeakKey, key.Type())
+	}
+	if key.Type() == ssh.KeyAlgoDSA && !policy.AllowDSA {
+		return fmt.Errorf("%w: dsa keys are not accepted", ErrWeakKey)
+	}
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil
+	}
+	switch public := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		min := policy.MinRSABits
+		if min == 0 {
+			min = MinRSABits
+		}
+		if bits := public.N.BitLen(); bits < min {
+			return fmt.Errorf("%w: rsa key of %d bits, at least %d required", ErrWeakKey, bits, min)
+		}
+	case *ecdsa.PublicKey:
+		min := policy.MinECDSABits
+		if min == 0 {
+			min = 256
+		}
+		if bits := public.Curve.Params().BitSize; bits < min {
+			return fmt.Errorf("%w: ecdsa key of %d bits, at least %d required", ErrWeakKey, bits, min)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func TestParseAuthorizedKey(t *testing.T) {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := `from="10.0.0.0/8",command="echo hi",no-pty ` + pair.AuthorizedKey + " deploy key"
+	key, err := ParseAuthorizedKey(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key.Options) != 3 || key.Options[1] != `command="echo hi"` || key.Comment != "deploy key" {
+		t.Fatalf("unexpected parsed key %+v", key)
+	}
+	if key.String() != line {
+		t.Fatalf("%q is not the original line", key.String())
+	}
+	if FingerprintSHA256(key.Key) != pair.Fingerprint {
+		t.Fatal("fingerprint of the parsed key differs")
+	}
+	if _, err := ParseAuthorizedKey("ssh-ed25519 not-base64"); err == nil {
+		t.Fatal("invalid key parsed")
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md5 := FingerprintMD5(pair.PublicKey)
+	for _, fingerprint := range []string{pair.Fingerprint, md5, md5[len("MD5:"):]} {
+		if !MatchesFingerprint(pair.PublicKey, fingerprint) {
+			t.Fatalf("%s does not match", fingerprint)
+		}
+	}
+	other, _ := GenerateKey(KeyOptions{})
+	if MatchesFingerprint(other.PublicKey, pair.Fingerprint) || MatchesFingerprint(other.PublicKey, md5) {
+		t.Fatal("fingerprint matches another key")
+	}
+}
+
+func TestKeyPairMatches(t *testing.T) {
+	pair, _ := GenerateKey(KeyOptions{Algorithm: ECDSAP256})
+	other, _ := GenerateKey(KeyOptions{Algorithm: ECDSAP256})
+	if !KeyPairMatches(pair.PrivateKey, pair.PublicKey) {
+		t.Fatal("key pair does not match")
+	}
+	if KeyPairMatches(pair.PrivateKey, other.PublicKey) {
+		t.Fatal("keys of different pairs match")
+	}
+}
+
+// testDSAKey is a fixed DSA key, generating DSA parameters takes too long for a test
+const testDSAKey = "ssh-dss AAAAB3NzaC1kc3MAAACBANf3N5VpOtwzjhjylxNeClZFtr9mM7cTpsUuy48b1Acr4hP1ii+8FUeW54GNSXWJEM85X6mrda6ZOkouoJFnnPg1REaAuctVOuZtf9ocTrNy7eqe0xAt4M6oY4joXMcL7RMy36Ubq6KRAS7RCYS/AfE/5qRvS7s1DIIU5tjxrOY7AAAAFQC7jO60zXH5IQLlIAw8lCR/igfKewAAAIEAzgEZOunBEX0tYcYOBZIxoleLYLQktNJ9TzrhnFhvHRbPHfEctbWqK3vXM4UOWxkpMB8RJbbK9DxcAzr5UL2abuxOXk6tCgJWiOIuZcAu8Aou3tP85glij6OK6ttpM8M6xJpu1Ismlji551DlxSbwwJNOvpntOdJzhVSbU+AECyoAAACAAytZthLoJU3aqL+fEOZvYPGu9HUfmwc/64Zjo2WTq5UlkepT0EtkQxgUlc/+waafowpo8IWtZz9iH7qZvDjrV5obH2wvnYe40P3X6tUtV3usaB9iPSeDfng9VZNev8M7wVN1PGcUNWli0J1KfQu09zg6m5qUwV6DMHfbY5pGswQ="
+
+func TestKeyPolicy(t *testing.T) {
+	weakRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsaPublic, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testDSAKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakRSAPublic, _ := ssh.NewPublicKey(&weakRSA.PublicKey)
+	ed25519Pair, _ := GenerateKey(KeyOptions{})
+	p256Pair, _ := GenerateKey(KeyOptions{Algorithm: ECDSAP256})
+
+	for _, weak := range []ssh.PublicKey{weakRSAPublic, dsaPublic} {
+		if err := DefaultKeyPolicy.Check(weak); !errors.Is(err, ErrWeakKey) {
+			t.Fatalf("%s: expected ErrWeakKey, got %v", weak.Type(), err)
+		}
+	}
+	for _, strong := range []ssh.PublicKey{ed25519Pair.PublicKey, p256Pair.PublicKey} {
+		if err := DefaultKeyPolicy.Check(strong); err != nil {
+			t.Fatalf("%s: %s", strong.Type(), err)
+		}
+	}
+	if err := (KeyPolicy{MinRSABits: 1024}).Check(weakRSAPublic); err != nil {
+		t.Fatal(err)
+	}
+	if err := (KeyPolicy{MinECDSABits: 384}).Check(p256Pair.PublicKey); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("expected ErrWeakKey, got %v", err)
+	}
+	onlyEd25519 := KeyPolicy{Types: []string{ssh.KeyAlgoED25519}}
+	if err := onlyEd25519.Check(p256Pair.PublicKey); !errors.Is(err, ErrWeakKey) {
+		t.Fatalf("expected ErrWeakKey, got %v", err)
+	}
+}
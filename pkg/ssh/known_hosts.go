@@ -0,0 +1,243 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownHost is returned by KnownHostsStrict callbacks for hosts without
+// a key in known_hosts, and by KnownHostsTOFU ones for hosts not confirmed
+var ErrUnknownHost = errors.New("host is not known")
+
+// ErrHostKeyChanged is returned when the host presents a key different from the
+// known one, which may be an attack
+var ErrHostKeyChanged = errors.New("host key has changed")
+
+// ErrHostKeyRevoked is returned for keys marked @revoked in known_hosts
+var ErrHostKeyRevoked = errors.New("host key is revoked")
+
+// KnownHostsMode is what a host key callback does with hosts not in known_hosts,
+// as StrictHostKeyChecking of OpenSSH. Changed host keys are always rejected.
+type KnownHostsMode int
+
+const (
+	// KnownHostsStrict rejects unknown hosts
+	KnownHostsStrict KnownHostsMode = iota
+	// KnownHostsTOFU trusts unknown hosts on first use if KnownHostsOptions.Confirm
+	// agrees (as ssh asks "Are you sure you want to continue connecting"), adding them
+	KnownHostsTOFU
+	// KnownHostsAcceptNew adds unknown hosts without asking
+	KnownHostsAcceptNew
+)
+
+type KnownHostsOptions struct {
+	Mode KnownHostsMode
+	// Hash hashes host names of added entries, as HashKnownHosts of OpenSSH
+	Hash bool
+	// Confirm decides on unknown hosts in KnownHostsTOFU mode, rejecting them if nil
+	Confirm func(hostname string, remote net.Addr, key ssh.PublicKey) bool
+}
+
+// KnownHosts is an OpenSSH known_hosts file. It understands hashed host names,
+// patterns, @cert-authority and @revoked lines. The file does not need to exist
+// until something is added to it.
+type KnownHosts struct {
+	path     string
+	mx       sync.Mutex
+	callback ssh.HostKeyCallback // of the current content, nil when it has to be read again
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+func (known *KnownHosts) Path() string {
+	return known.path
+}
+
+// check checks the key against the file, reading it again if it was changed by us
+func (known *KnownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	known.mx.Lock()
+	if known.callback == nil {
+		files := []string{known.path}
+		if _, err := os.Stat(known.path); os.IsNotExist(err) {
+			files = nil
+		}
+		callback, err := knownhosts.New(files...)
+		if err != nil {
+			known.mx.Unlock()
+			return err
+		}
+		known.callback = callback
+	}
+	callback := known.callback
+	known.mx.Unlock()
+	return callback(hostname, remote, key)
+}
+
+// noAuthorityError starts the error of knownhosts for host certificates signed by
+// a CA no @cert-authority line trusts for the host. knownhosts does not export it.
+const noAuthorityError = "ssh: no authorities for hostname"
+
+// HostKeyCallback returns ssh.ClientConfig.HostKeyCallback checking hosts against
+// the file. Hosts presenting certificates are accepted if signed by a CA of a
+// matching @cert-authority line. Otherwise, as OpenSSH does, the key of the
+// certificate is checked (and added in KnownHostsTOFU and KnownHostsAcceptNew
+// modes) as a plain host key.
+func (known *KnownHosts) HostKeyCallback(options KnownHostsOptions) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known.check(hostname, remote, key)
+		if cert, ok := key.(*ssh.Certificate); ok && err != nil && strings.HasPrefix(err.Error(), noAuthorityError) {
+			key = cert.Key
+			err = known.check(hostname, remote, key)
+		}
+		var keyErr *knownhosts.KeyError
+		var revokedErr *knownhosts.RevokedError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &revokedErr):
+			return fmt.Errorf("%w: %s", ErrHostKeyRevoked, err)
+		case !errors.As(err, &keyErr):
+			return err
+		case len(keyErr.Want) != 0:
+			return fmt.Errorf("%w: %s presents %s %s", ErrHostKeyChanged, hostname, key.Type(), FingerprintSHA256(key))
+		}
+		unknown := fmt.Errorf("%w: %s (%s %s)", ErrUnknownHost, hostname, key.Type(), FingerprintSHA256(key))
+		switch options.Mode {
+		case KnownHostsAcceptNew:
+		case KnownHostsTOFU:
+			if options.Confirm == nil || !options.Confirm(hostname, remote, key) {
+				return unknown
+			}
+		default:
+			return unknown
+		}
+		return known.Add([]string{hostname}, key, options.Hash)
+	}
+}
+
+// Add appends a line trusting the key for the hosts (host or host:port). Hashed
+// hosts get a line each, as OpenSSH reads only one hashed name per line.
+func (known *KnownHosts) Add(hosts []string, key ssh.PublicKey, hash bool) error {
+	if !hash {
+		return known.append(knownhosts.Line(hosts, key))
+	}
+	lines := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		lines = append(lines, knownhosts.HashHostname(knownhosts.Normalize(host))+" "+serializeKey(key))
+	}
+	return known.append(lines...)
+}
+
+// AddCertAuthority appends a @cert-authority line trusting host certificates
+// signed by the CA for hosts matching the pattern (e.g. "*.example.com")
+func (known *KnownHosts) AddCertAuthority(pattern string, ca ssh.PublicKey) error {
+	return known.append("@cert-authority " + pattern + " " + serializeKey(ca))
+}
+
+// Revoke appends a @revoked line, so that the key is rejected for any host
+func (known *KnownHosts) Revoke(key ssh.PublicKey) error {
+	return known.append("@revoked * " + serializeKey(key))
+}
+
+func (known *KnownHosts) append(lines ...string) error {
+	known.mx.Lock()
+	defer known.mx.Unlock()
+	if err := os.MkdirAll(filepath.Dir(known.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(known.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	known.callback = nil
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	return err
+}
+
+// Remove removes the keys of the host (host or host:port), as ssh-keygen -R does:
+// lines naming the host, in plain or hashed form, are removed. Lines matching it
+// by wildcard patterns and marker lines are kept.
+func (known *KnownHosts) Remove(host string) (removed int, err error) {
+	known.mx.Lock()
+	defer known.mx.Unlock()
+	content, err := ioutil.ReadFile(known.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	host = knownhosts.Normalize(host)
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if namesHost(line, host) {
+			removed++
+			continue
+		}
+		kept.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	known.callback = nil
+	return removed, writeFileAtomic(known.path, kept.Bytes(), 0600)
+}
+
+// namesHost tells whether the host list of the known_hosts line has the host
+func namesHost(line string, host string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+		return false
+	}
+	for _, pattern := range strings.Split(fields[0], ",") {
+		if pattern == host || hashedHostMatches(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedHostMatches checks host against "|1|base64(salt)|base64(hmac-sha1(salt, host))"
+func hashedHostMatches(pattern string, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// serializeKey returns the key as in authorized_keys and known_hosts, without comment
+func serializeKey(key ssh.PublicKey) string {
+	return authorizedKey(key, "")
+}
@@ -0,0 +1,146 @@
+package ssh
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pair, err := GenerateKey(KeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair.PublicKey
+}
+
+func TestKnownHostsModes(t *testing.T) {
+	known := NewKnownHosts(filepath.Join(t.TempDir(), ".ssh", "known_hosts"))
+	key := newHostKey(t)
+	strict := known.HostKeyCallback(KnownHostsOptions{Mode: KnownHostsStrict})
+	if err := strict("relay:22", testRemote, key); !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("expected ErrUnknownHost, got %v", err)
+	}
+
+	refusing := known.HostKeyCallback(KnownHostsOptions{
+		Mode:    KnownHostsTOFU,
+		Confirm: func(string, net.Addr, ssh.PublicKey) bool { return false },
+	})
+	if err := refusing("relay:22", testRemote, key); !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("expected ErrUnknownHost, got %v", err)
+	}
+	confirming := known.HostKeyCallback(KnownHostsOptions{
+		Mode:    KnownHostsTOFU,
+		Hash:    true,
+		Confirm: func(string, net.Addr, ssh.PublicKey) bool { return true },
+	})
+	if err := confirming("relay:22", testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict("relay:22", testRemote, key); err != nil {
+		t.Fatalf("confirmed host is not known: %s", err)
+	}
+	content, _ := ioutil.ReadFile(known.Path())
+	if !strings.HasPrefix(string(content), "|1|") || strings.Contains(string(content), "relay") {
+		t.Fatalf("host name is not hashed: %s", content)
+	}
+
+	acceptNew := known.HostKeyCallback(KnownHostsOptions{Mode: KnownHostsAcceptNew})
+	if err := acceptNew("other:2222", testRemote, key); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(known.Path())
+	if !strings.Contains(string(content), "[other]:2222 ") {
+		t.Fatalf("unexpected known_hosts %s", content)
+	}
+	if err := acceptNew("relay:22", testRemote, newHostKey(t)); !errors.Is(err, ErrHostKeyChanged) {
+		t.Fatalf("expected ErrHostKeyChanged, got %v", err)
+	}
+}
+
+func TestKnownHostsCertAuthorityAndRevocation(t *testing.T) {
+	known := NewKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	ca := newTestCA(t)
+	_, cert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignHostCert(key, CertOptions{Principals: []string{"relay.example.com"}})
+	})
+	strict := known.HostKeyCallback(KnownHostsOptions{})
+	if err := known.AddCertAuthority("*.example.com", ca.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict("relay.example.com:22", testRemote, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newHostKey(t)
+	if err := known.Add([]string{"relay:22"}, key, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := known.Revoke(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := strict("relay:22", testRemote, key); !errors.Is(err, ErrHostKeyRevoked) {
+		t.Fatalf("expected ErrHostKeyRevoked, got %v", err)
+	}
+}
+
+func TestKnownHostsCertificateOfUnknownAuthority(t *testing.T) {
+	known := NewKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	ca := newTestCA(t)
+	_, cert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignHostCert(key, CertOptions{Principals: []string{"relay"}})
+	})
+	strict := known.HostKeyCallback(KnownHostsOptions{})
+	if err := strict("relay:22", testRemote, cert); !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("expected ErrUnknownHost, got %v", err)
+	}
+
+	acceptNew := known.HostKeyCallback(KnownHostsOptions{Mode: KnownHostsAcceptNew})
+	if err := acceptNew("relay:22", testRemote, cert); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(known.Path())
+	if !strings.Contains(string(content), serializeKey(cert.Key)) {
+		t.Fatalf("key of the certificate is not added: %s", content)
+	}
+	if err := strict("relay:22", testRemote, cert); err != nil {
+		t.Fatalf("certificate with a known key rejected: %s", err)
+	}
+
+	_, otherCert := newCertSigner(t, func(key ssh.PublicKey) (*ssh.Certificate, error) {
+		return ca.SignHostCert(key, CertOptions{Principals: []string{"relay"}})
+	})
+	if err := acceptNew("relay:22", testRemote, otherCert); !errors.Is(err, ErrHostKeyChanged) {
+		t.Fatalf("expected ErrHostKeyChanged, got %v", err)
+	}
+}
+
+func TestKnownHostsRemove(t *testing.T) {
+	known := NewKnownHosts(filepath.Join(t.TempDir(), "known_hosts"))
+	key, otherKey := newHostKey(t), newHostKey(t)
+	for _, hash := range []bool{false, true} {
+		if err := known.Add([]string{"relay:22"}, key, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := known.Add([]string{"other:22"}, otherKey, true); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := known.Remove("relay")
+	if err != nil || removed != 2 {
+		t.Fatalf("removed %d lines, err %v", removed, err)
+	}
+	strict := known.HostKeyCallback(KnownHostsOptions{})
+	if err := strict("relay:22", testRemote, key); !errors.Is(err, ErrUnknownHost) {
+		t.Fatalf("expected ErrUnknownHost, got %v", err)
+	}
+	if err := strict("other:22", testRemote, otherKey); err != nil {
+		t.Fatal(err)
+	}
+}
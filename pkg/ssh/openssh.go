@@ -0,0 +1,179 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+)
+
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+const (
+	opensshMagic  = "openssh-key-v1\x00"
+	opensshCipher = "aes256-ctr"
+	opensshKDF    = "bcrypt"
+	// OpenSSHRounds is the number of bcrypt rounds used to encrypt keys, as ssh-keygen does
+	OpenSSHRounds = 16
+)
+
+// encodePrivateKeyToOpenSSH encodes Private Key to "OPENSSH PRIVATE KEY" PEM,
+// encrypted with passphrase unless it is empty
+func encodePrivateKeyToOpenSSH(privateKey crypto.Signer, comment string, passphrase []byte) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyFields, err := opensshKeyFields(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	block := append(append(check, check...), ssh.Marshal(struct{ Keytype string }{publicKey.Type()})...)
+	block = append(block, keyFields...)
+	block = append(block, ssh.Marshal(struct{ Comment string }{comment})...)
+
+	envelope := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName: "none",
+		KdfName:    "none",
+		NumKeys:    1,
+		PubKey:     publicKey.Marshal(),
+	}
+	if len(passphrase) == 0 {
+		envelope.PrivKeyBlock = pad(block, 8)
+	} else {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key := bcryptPBKDF(passphrase, salt, OpenSSHRounds, 32+aes.BlockSize)
+		c, err := aes.NewCipher(key[:32])
+		if err != nil {
+			return nil, err
+		}
+		block = pad(block, aes.BlockSize)
+		cipher.NewCTR(c, key[32:]).XORKeyStream(block, block)
+		envelope.CipherName = opensshCipher
+		envelope.KdfName = opensshKDF
+		envelope.KdfOpts = string(ssh.Marshal(struct {
+			Salt   string
+			Rounds uint32
+		}{string(salt), OpenSSHRounds}))
+		envelope.PrivKeyBlock = block
+	}
+	der := append([]byte(opensshMagic), ssh.Marshal(envelope)...)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: der}), nil
+}
+
+// opensshKeyFields returns the private key fields that follow the key type
+func opensshKeyFields(privateKey crypto.Signer) ([]byte, error) {
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		key.Precompute()
+		return ssh.Marshal(struct {
+			N, E, D, Iqmp, P, Q *big.Int
+		}{key.N, big.NewInt(int64(key.E)), key.D, key.Precomputed.Qinv, key.Primes[0], key.Primes[1]}), nil
+	case *ecdsa.PrivateKey:
+		var curve string
+		switch key.Curve {
+		case elliptic.P256():
+			curve = "nistp256"
+		case elliptic.P384():
+			curve = "nistp384"
+		case elliptic.P521():
+			curve = "nistp521"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		return ssh.Marshal(struct {
+			Curve string
+			Pub   []byte
+			D     *big.Int
+		}{curve, elliptic.Marshal(key.Curve, key.X, key.Y), key.D}), nil
+	case ed25519.PrivateKey:
+		return ssh.Marshal(struct {
+			Pub  []byte
+			Priv []byte
+		}{[]byte(key.Public().(ed25519.PublicKey)), []byte(key)}), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", privateKey)
+}
+
+// pad adds 1, 2, 3... bytes up to a multiple of blockSize
+func pad(block []byte, blockSize int) []byte {
+	for i := 1; len(block)%blockSize != 0; i++ {
+		block = append(block, byte(i))
+	}
+	return block
+}
+
+// bcryptPBKDF is bcrypt_pbkdf(3) from OpenBSD, the key derivation of encrypted OpenSSH keys
+func bcryptPBKDF(password, salt []byte, rounds, keyLen int) []byte {
+	const blockSize = 32
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+
+	shapass := sha512.Sum512(password)
+	tmp := make([]byte, blockSize)
+	for block := 1; block <= numBlocks; block++ {
+		counter := make([]byte, 4)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		shasalt := sha512.Sum512(append(append([]byte{}, salt...), counter...))
+		bcryptHash(tmp, shapass[:], shasalt[:])
+
+		out := make([]byte, blockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			shasalt = sha512.Sum512(tmp)
+			bcryptHash(tmp, shapass[:], shasalt[:])
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+	return key[:keyLen]
+}
+
+func bcryptHash(out, shapass, shasalt []byte) {
+	c, err := blowfish.NewSaltedCipher(shapass, shasalt)
+	if err != nil {
+		panic(err) // key and salt are sha512 sums, always of valid size
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+	copy(out, "OxychromaticBlowfishSwatDynamite")
+	for i := 0; i < 32; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// blowfish works with big endian words, bcrypt_pbkdf with little endian ones
+	for i := 0; i < 32; i += 4 {
+		out[i+3], out[i+2], out[i+1], out[i] = out[i], out[i+1], out[i+2], out[i+3]
+	}
+}
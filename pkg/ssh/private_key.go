@@ -0,0 +1,74 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPassphraseRequired is returned when parsing an encrypted key without passphrase
+var ErrPassphraseRequired = errors.New("private key is encrypted, passphrase required")
+
+// ErrWrongPassphrase is returned when an encrypted key cannot be decrypted with the passphrase
+var ErrWrongPassphrase = errors.New("wrong passphrase for private key")
+
+// KeyFormat is the encoding of private keys
+type KeyFormat int
+
+const (
+	// FormatPEM is PKCS#1 for RSA, SEC 1 for ECDSA and PKCS#8 for Ed25519 keys
+	FormatPEM KeyFormat = iota
+	// FormatOpenSSH is "OPENSSH PRIVATE KEY", written by ssh-keygen by default
+	FormatOpenSSH
+)
+
+// MarshalPrivateKey encodes the private key in the format. Keys with passphrase
+// are encrypted with aes256-ctr and bcrypt as ssh-keygen does, which exists
+// only in FormatOpenSSH, so they are always in that format.
+func MarshalPrivateKey(privateKey crypto.Signer, format KeyFormat, comment string, passphrase []byte) ([]byte, error) {
+	if format == FormatOpenSSH || len(passphrase) != 0 {
+		return encodePrivateKeyToOpenSSH(privateKey, comment, passphrase)
+	}
+	return encodePrivateKeyToPEM(privateKey)
+}
+
+// ParseRawPrivateKey parses a private key in any of the formats of MarshalPrivateKey
+// (or the encrypted PEM of older tools), decrypting it with passphrase if it is
+// encrypted. Passphrase is ignored for keys that are not encrypted.
+func ParseRawPrivateKey(data []byte, passphrase []byte) (crypto.Signer, error) {
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseRequired
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// ed25519 keys in OpenSSH format are parsed as pointers
+	if pointer, ok := key.(*ed25519.PrivateKey); ok {
+		key = *pointer
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// ParsePrivateKey is ParseRawPrivateKey returning the key as ssh.Signer
+func ParsePrivateKey(data []byte, passphrase []byte) (ssh.Signer, error) {
+	key, err := ParseRawPrivateKey(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
@@ -0,0 +1,366 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultRotationRetry is how long Rotator.Run waits after a failed rotation
+// when RotationOptions.RetryInterval is not set
+const DefaultRotationRetry = time.Minute
+
+type RotationOptions struct {
+	// Key configures the generated keys. Their private keys are stored in the
+	// state file, encrypted only if Key.Passphrase is set.
+	Key KeyOptions
+	// Interval is how long a key is the current one before the next is generated
+	Interval time.Duration
+	// Overlap is how long a replaced key stays valid after its successor is
+	// published, so that the new key reaches everything checking it meanwhile
+	Overlap time.Duration
+	// StatePath is the JSON file keeping the keys and when they were rotated,
+	// it is written with mode 0600
+	StatePath string
+	// Publish is called with a new key before it becomes the current one, e.g. to
+	// add it to authorized_keys. If it fails, it is retried with the same key and
+	// the previous key stays current. It may get a key again after a restart, so
+	// it must not fail for keys it already published.
+	Publish func(pair *KeyPair) error
+	// Retire is called with keys whose overlap window is over, e.g. to remove
+	// them from authorized_keys. Failed retirements are retried.
+	Retire func(pair *KeyPair) error
+	// RetryInterval is how long Run waits after a failure, DefaultRotationRetry if 0
+	RetryInterval time.Duration
+	// OnError is told about failures of Run, which keeps running
+	OnError func(err error)
+}
+
+// rotatedKey is a key of the rotation as kept in the state file
+type rotatedKey struct {
+	Algorithm     Algorithm `json:"algorithm"`
+	PrivateKey    string    `json:"private_key"`
+	AuthorizedKey string    `json:"authorized_key"`
+	Created       time.Time `json:"created"`
+	// PublishedAt is when Publish succeeded, nil for a new key until then.
+	// The interval is counted from it.
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	// Retires is when the overlap window of a replaced key ends, nil for the current key
+	Retires *time.Time `json:"retires,omitempty"`
+
+	pair *KeyPair
+}
+
+func (key *rotatedKey) published() bool {
+	return key.PublishedAt != nil
+}
+
+func (key *rotatedKey) valid(now time.Time) bool {
+	return key.published() && (key.Retires == nil || now.Before(*key.Retires))
+}
+
+// rotatesAt is when the published key is due to be replaced. Publishing may
+// fail for long, so the interval is counted from publishing.
+func (key *rotatedKey) rotatesAt(interval time.Duration) time.Time {
+	return key.PublishedAt.Add(interval)
+}
+
+type rotationState struct {
+	Keys []*rotatedKey `json:"keys"`
+}
+
+// Rotator replaces a key on a schedule. A new key is published with
+// RotationOptions.Publish before it becomes the current one, the replaced key
+// stays valid for the overlap window and is then retired with
+// RotationOptions.Retire. Every step is saved to the state file first, so a
+// restarted Rotator continues the rotation where it stopped.
+type Rotator struct {
+	options RotationOptions
+	now     func() time.Time
+
+	// rotateMx serializes rotations, which may take long with the callbacks
+	rotateMx sync.Mutex
+	mx       sync.Mutex
+	keys     []*rotatedKey // oldest first
+}
+
+// NewRotator loads the state of the rotation, which does not need to exist.
+// Nothing is generated until Check, Rotate or Run.
+func NewRotator(options RotationOptions) (*Rotator, error) {
+	if options.Interval <= 0 {
+		return nil, errors.New("rotation interval must be positive")
+	}
+	if options.Overlap < 0 {
+		return nil, errors.New("rotation overlap cannot be negative")
+	}
+	if options.StatePath == "" {
+		return nil, errors.New("rotation needs a state file")
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultRotationRetry
+	}
+	rotator := &Rotator{options: options, now: time.Now}
+	if err := rotator.load(); err != nil {
+		return nil, fmt.Errorf("cannot load rotation state %s: %w", options.StatePath, err)
+	}
+	return rotator, nil
+}
+
+func (rotator *Rotator) load() error {
+	content, err := ioutil.ReadFile(rotator.options.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state rotationState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+	for _, key := range state.Keys {
+		privateKey, err := ParseRawPrivateKey([]byte(key.PrivateKey), rotator.options.Key.Passphrase)
+		if err != nil {
+			return err
+		}
+		publicKey, err := ssh.NewPublicKey(privateKey.Public())
+		if err != nil {
+			return err
+		}
+		key.pair = &KeyPair{
+			Algorithm:     key.Algorithm,
+			PrivateKey:    privateKey,
+			PublicKey:     publicKey,
+			PrivatePEM:    key.PrivateKey,
+			AuthorizedKey: key.AuthorizedKey,
+			Fingerprint:   ssh.FingerprintSHA256(publicKey),
+		}
+	}
+	rotator.keys = state.Keys
+	return nil
+}
+
+func (rotator *Rotator) save() error {
+	rotator.mx.Lock()
+	content, err := json.MarshalIndent(rotationState{Keys: rotator.keys}, "", "  ")
+	rotator.mx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rotator.options.StatePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(rotator.options.StatePath, content, 0600)
+}
+
+// Current returns the key to use, the last published one, nil if none was published yet
+func (rotator *Rotator) Current() *KeyPair {
+	rotator.mx.Lock()
+	defer rotator.mx.Unlock()
+	if key := rotator.current(); key != nil {
+		return key.pair
+	}
+	return nil
+}
+
+// Valid returns the current key followed by the replaced keys still in their
+// overlap window, e.g. to accept any of them
+func (rotator *Rotator) Valid() []*KeyPair {
+	rotator.mx.Lock()
+	defer rotator.mx.Unlock()
+	now := rotator.now()
+	var pairs []*KeyPair
+	for i := len(rotator.keys) - 1; i >= 0; i-- {
+		if rotator.keys[i].valid(now) {
+			pairs = append(pairs, rotator.keys[i].pair)
+		}
+	}
+	return pairs
+}
+
+// current returns the last published key, with mx locked
+func (rotator *Rotator) current() *rotatedKey {
+	for i := len(rotator.keys) - 1; i >= 0; i-- {
+		if rotator.keys[i].published() {
+			return rotator.keys[i]
+		}
+	}
+	return nil
+}
+
+// pending returns the generated key waiting to be published, with mx locked
+func (rotator *Rotator) pending() *rotatedKey {
+	if len(rotator.keys) == 0 || rotator.keys[len(rotator.keys)-1].published() {
+		return nil
+	}
+	return rotator.keys[len(rotator.keys)-1]
+}
+
+// Check does what is due: generates the first key or the next one when the
+// current key is older than the interval, publishes a key whose publishing
+// failed before and retires keys at the end of their overlap window
+func (rotator *Rotator) Check() error {
+	return rotator.rotate(false)
+}
+
+// Rotate replaces the current key now, e.g. when it may be compromised. The
+// replaced key still gets the overlap window, use Retire to drop it at once.
+func (rotator *Rotator) Rotate() error {
+	return rotator.rotate(true)
+}
+
+func (rotator *Rotator) rotate(force bool) error {
+	rotator.rotateMx.Lock()
+	defer rotator.rotateMx.Unlock()
+	now := rotator.now()
+	rotator.mx.Lock()
+	current, pending := rotator.current(), rotator.pending()
+	rotator.mx.Unlock()
+
+	if pending == nil && (force || current == nil || !now.Before(current.rotatesAt(rotator.options.Interval))) {
+		pair, err := GenerateKey(rotator.options.Key)
+		if err != nil {
+			return err
+		}
+		pending = &rotatedKey{
+			Algorithm:     pair.Algorithm,
+			PrivateKey:    pair.PrivatePEM,
+			AuthorizedKey: pair.AuthorizedKey,
+			Created:       now,
+			pair:          pair,
+		}
+		rotator.mx.Lock()
+		rotator.keys = append(rotator.keys, pending)
+		rotator.mx.Unlock()
+		// saved before publishing, so that a key published before a crash is not lost
+		if err := rotator.save(); err != nil {
+			return err
+		}
+	}
+	if pending != nil {
+		if rotator.options.Publish != nil {
+			if err := rotator.options.Publish(pending.pair); err != nil {
+				return fmt.Errorf("cannot publish key %s: %w", pending.pair.Fingerprint, err)
+			}
+		}
+		published := rotator.now()
+		retires := published.Add(rotator.options.Overlap)
+		rotator.mx.Lock()
+		pending.PublishedAt = &published
+		if current != nil {
+			current.Retires = &retires
+		}
+		rotator.mx.Unlock()
+		if err := rotator.save(); err != nil {
+			return err
+		}
+	}
+	return rotator.retire(func(key *rotatedKey) bool {
+		return key.Retires != nil && !rotator.now().Before(*key.Retires)
+	})
+}
+
+// Retire retires the replaced keys at once, without waiting for the end of
+// their overlap window
+func (rotator *Rotator) Retire() error {
+	rotator.rotateMx.Lock()
+	defer rotator.rotateMx.Unlock()
+	return rotator.retire(func(key *rotatedKey) bool {
+		return key.Retires != nil
+	})
+}
+
+// retire calls RotationOptions.Retire for the keys due, removing those it
+// succeeds for. Returns the first failure.
+func (rotator *Rotator) retire(due func(key *rotatedKey) bool) error {
+	rotator.mx.Lock()
+	var retiring []*rotatedKey
+	for _, key := range rotator.keys {
+		if due(key) {
+			retiring = append(retiring, key)
+		}
+	}
+	rotator.mx.Unlock()
+	if len(retiring) == 0 {
+		return nil
+	}
+	var firstErr error
+	retired := make(map[*rotatedKey]bool)
+	for _, key := range retiring {
+		if rotator.options.Retire != nil {
+			if err := rotator.options.Retire(key.pair); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("cannot retire key %s: %w", key.pair.Fingerprint, err)
+				}
+				continue
+			}
+		}
+		retired[key] = true
+	}
+	if len(retired) == 0 {
+		return firstErr
+	}
+	rotator.mx.Lock()
+	kept := rotator.keys[:0]
+	for _, key := range rotator.keys {
+		if !retired[key] {
+			kept = append(kept, key)
+		}
+	}
+	rotator.keys = kept
+	rotator.mx.Unlock()
+	if err := rotator.save(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// next returns when something is due next
+func (rotator *Rotator) next() time.Time {
+	rotator.mx.Lock()
+	defer rotator.mx.Unlock()
+	current := rotator.current()
+	if current == nil || rotator.pending() != nil {
+		return rotator.now()
+	}
+	next := current.rotatesAt(rotator.options.Interval)
+	for _, key := range rotator.keys {
+		if key.Retires != nil && key.Retires.Before(next) {
+			next = *key.Retires
+		}
+	}
+	return next
+}
+
+// Run checks the rotation whenever something is due until ctx is done.
+// Failures are passed to RotationOptions.OnError and retried after
+// RotationOptions.RetryInterval.
+func (rotator *Rotator) Run(ctx context.Context) error {
+	for {
+		wait := rotator.next().Sub(rotator.now())
+		if wait <= 0 {
+			if err := rotator.Check(); err != nil {
+				if rotator.options.OnError != nil {
+					rotator.options.OnError(err)
+				}
+				wait = rotator.options.RetryInterval
+			} else {
+				wait = rotator.next().Sub(rotator.now())
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
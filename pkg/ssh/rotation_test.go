@@ -0,0 +1,186 @@
+package ssh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type rotationRecorder struct {
+	published []string
+	retired   []string
+	failing   bool
+}
+
+func (recorder *rotationRecorder) options(statePath string) RotationOptions {
+	return RotationOptions{
+		Interval:  24 * time.Hour,
+		Overlap:   time.Hour,
+		StatePath: statePath,
+		Publish: func(pair *KeyPair) error {
+			if recorder.failing {
+				return errors.New("key server is down")
+			}
+			recorder.published = append(recorder.published, pair.Fingerprint)
+			return nil
+		},
+		Retire: func(pair *KeyPair) error {
+			recorder.retired = append(recorder.retired, pair.Fingerprint)
+			return nil
+		},
+	}
+}
+
+func newTestRotator(t *testing.T, options RotationOptions, now *time.Time) *Rotator {
+	rotator, err := NewRotator(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator.now = func() time.Time { return *now }
+	return rotator
+}
+
+func fingerprints(pairs []*KeyPair) []string {
+	var result []string
+	for _, pair := range pairs {
+		result = append(result, pair.Fingerprint)
+	}
+	return result
+}
+
+func TestRotatorOverlap(t *testing.T) {
+	recorder := &rotationRecorder{}
+	now := time.Unix(1700000000, 0)
+	rotator := newTestRotator(t, recorder.options(filepath.Join(t.TempDir(), "rotation.json")), &now)
+	if rotator.Current() != nil {
+		t.Fatal("key before the first check")
+	}
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	first := rotator.Current()
+	if first == nil || len(recorder.published) != 1 || recorder.published[0] != first.Fingerprint {
+		t.Fatalf("first key not published: %v", recorder.published)
+	}
+
+	now = now.Add(12 * time.Hour)
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if rotator.Current() != first || len(recorder.published) != 1 {
+		t.Fatal("key rotated before the interval")
+	}
+
+	now = now.Add(12 * time.Hour)
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	second := rotator.Current()
+	valid := fingerprints(rotator.Valid())
+	if second == first || len(valid) != 2 || valid[0] != second.Fingerprint || valid[1] != first.Fingerprint {
+		t.Fatalf("unexpected valid keys %v after rotation", valid)
+	}
+	if len(recorder.retired) != 0 {
+		t.Fatal("key retired before the end of the overlap")
+	}
+
+	now = now.Add(time.Hour)
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.retired) != 1 || recorder.retired[0] != first.Fingerprint {
+		t.Fatalf("old key not retired: %v", recorder.retired)
+	}
+	if valid := fingerprints(rotator.Valid()); len(valid) != 1 || valid[0] != second.Fingerprint {
+		t.Fatalf("unexpected valid keys %v after overlap", valid)
+	}
+}
+
+func TestRotatorSurvivesRestart(t *testing.T) {
+	recorder := &rotationRecorder{}
+	statePath := filepath.Join(t.TempDir(), "keys", "rotation.json")
+	options := recorder.options(statePath)
+	options.Key.Passphrase = []byte("secret")
+	now := time.Unix(1700000000, 0)
+	rotator := newTestRotator(t, options, &now)
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	first := rotator.Current()
+
+	now = now.Add(24 * time.Hour)
+	recorder.failing = true
+	if err := rotator.Check(); err == nil {
+		t.Fatal("failed publish not reported")
+	}
+	if rotator.Current().Fingerprint != first.Fingerprint {
+		t.Fatal("unpublished key became current")
+	}
+	if info, err := os.Stat(statePath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("state file not saved with mode 0600: %v %v", info, err)
+	}
+
+	wrong := options
+	wrong.Key.Passphrase = []byte("wrong")
+	if _, err := NewRotator(wrong); err == nil {
+		t.Fatal("state loaded with wrong passphrase")
+	}
+
+	recorder.failing = false
+	restarted := newTestRotator(t, options, &now)
+	if restarted.Current().Fingerprint != first.Fingerprint {
+		t.Fatal("current key not restored")
+	}
+	if err := restarted.Check(); err != nil {
+		t.Fatal(err)
+	}
+	second := restarted.Current()
+	if second.Fingerprint == first.Fingerprint || len(recorder.published) != 2 || recorder.published[1] != second.Fingerprint {
+		t.Fatalf("pending key not published after restart: %v", recorder.published)
+	}
+	if _, err := ParsePrivateKey([]byte(second.PrivatePEM), options.Key.Passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Hour)
+	restarted = newTestRotator(t, options, &now)
+	if err := restarted.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.retired) != 1 || recorder.retired[0] != first.Fingerprint {
+		t.Fatalf("old key not retired after restart: %v", recorder.retired)
+	}
+}
+
+func TestRotatorCountsIntervalFromPublishing(t *testing.T) {
+	recorder := &rotationRecorder{failing: true}
+	now := time.Unix(1700000000, 0)
+	rotator := newTestRotator(t, recorder.options(filepath.Join(t.TempDir(), "rotation.json")), &now)
+	if err := rotator.Check(); err == nil {
+		t.Fatal("failed publish not reported")
+	}
+
+	// the key server is back after longer than the interval
+	now = now.Add(30 * time.Hour)
+	recorder.failing = false
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	first := rotator.Current()
+	if first == nil || len(recorder.published) != 1 {
+		t.Fatalf("key not published: %v", recorder.published)
+	}
+	if next := rotator.next(); !next.Equal(now.Add(24 * time.Hour)) {
+		t.Fatalf("next rotation at %s, expected a day after publishing", next)
+	}
+
+	now = now.Add(time.Minute)
+	if err := rotator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if rotator.Current() != first || len(recorder.published) != 1 {
+		t.Fatal("key rotated right after it was published")
+	}
+}
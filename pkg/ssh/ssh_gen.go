@@ -1,75 +1,169 @@
 package ssh
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"golang.org/x/crypto/ssh"
-	"log"
+	"io"
 	"strings"
 )
 
-func GenerateSSHKeys() (private string, public string, err error) {
-	bitSize := 4096
+// Algorithm is the type of the generated key
+type Algorithm string
 
-	privateKey, err := generatePrivateKey(bitSize)
-	if err != nil {
-		return "", "", err
-	}
+const (
+	Ed25519   Algorithm = "ed25519"
+	ECDSAP256 Algorithm = "ecdsa-p256"
+	ECDSAP384 Algorithm = "ecdsa-p384"
+	ECDSAP521 Algorithm = "ecdsa-p521"
+	RSA       Algorithm = "rsa"
+)
 
-	publicKeyBytes, err := generatePublicKey(&privateKey.PublicKey)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-	privateKeyBytes := encodePrivateKeyToPEM(privateKey)
-	private = string(privateKeyBytes)
-	public = strings.Trim(string(publicKeyBytes), "\n")
-	return private, public, nil
+// DefaultRSABits is the size of RSA keys when KeyOptions.Bits is not set
+const DefaultRSABits = 3072
+
+// MinRSABits is the smallest RSA key GenerateKey agrees to generate
+const MinRSABits = 2048
+
+type KeyOptions struct {
+	// Algorithm of the key, Ed25519 if empty
+	Algorithm Algorithm
+	// Bits is the size of RSA keys, DefaultRSABits if 0. Ignored by other algorithms
+	Bits int
+	// Comment is appended to the authorized_keys line and stored in OpenSSH private keys
+	Comment string
+	// Format of KeyPair.PrivatePEM, FormatPEM if not set
+	Format KeyFormat
+	// Passphrase encrypts the private key, which is then always in FormatOpenSSH
+	Passphrase []byte
+	// Rand is the source of randomness, crypto/rand.Reader if nil
+	Rand io.Reader
+}
+
+// KeyPair is a generated key in the forms it is usually stored and shown in
+type KeyPair struct {
+	Algorithm Algorithm
+	// PrivateKey is one of *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey
+	PrivateKey crypto.Signer
+	PublicKey  ssh.PublicKey
+	// PrivatePEM is the private key encoded in the format of KeyOptions
+	// (see MarshalPrivateKey), load it back with ParsePrivateKey
+	PrivatePEM string
+	// AuthorizedKey is the public key as a line of authorized_keys, without newline
+	AuthorizedKey string
+	// Fingerprint is the SHA256 fingerprint of the public key ("SHA256:...")
+	Fingerprint string
 }
 
-// generatePrivateKey creates an RSA Private Key of specified byte size
-func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
-	// Private Key generation
-	privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
+// GenerateKey generates a key pair of the algorithm chosen in options
+func GenerateKey(options KeyOptions) (*KeyPair, error) {
+	if options.Algorithm == "" {
+		options.Algorithm = Ed25519
+	}
+	if options.Rand == nil {
+		options.Rand = rand.Reader
+	}
+	privateKey, err := generatePrivateKey(options)
 	if err != nil {
 		return nil, err
 	}
-
-	// Validate Private Key
-	err = privateKey.Validate()
+	privatePEM, err := MarshalPrivateKey(privateKey, options.Format, options.Comment, options.Passphrase)
 	if err != nil {
 		return nil, err
 	}
-
-	return privateKey, nil
+	publicKey, err := ssh.NewPublicKey(privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		Algorithm:     options.Algorithm,
+		PrivateKey:    privateKey,
+		PublicKey:     publicKey,
+		PrivatePEM:    string(privatePEM),
+		AuthorizedKey: authorizedKey(publicKey, options.Comment),
+		Fingerprint:   ssh.FingerprintSHA256(publicKey),
+	}, nil
 }
 
-// encodePrivateKeyToPEM encodes Private Key from RSA to PEM format
-func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
-	// Get ASN.1 DER format
-	privDER := x509.MarshalPKCS1PrivateKey(privateKey)
-
-	// pem.Block
-	privBlock := pem.Block{
-		Type:    "RSA PRIVATE KEY",
-		Headers: nil,
-		Bytes:   privDER,
+// GenerateSSHKeys generates 4096-bit RSA key, returning it in PEM and
+// as authorized_keys line.
+//
+// Deprecated: use GenerateKey, which supports faster algorithms
+func GenerateSSHKeys() (private string, public string, err error) {
+	pair, err := GenerateKey(KeyOptions{Algorithm: RSA, Bits: 4096})
+	if err != nil {
+		return "", "", err
 	}
+	return pair.PrivatePEM, pair.AuthorizedKey, nil
+}
 
-	// Private key in PEM format
-	privatePEM := pem.EncodeToMemory(&privBlock)
+// generatePrivateKey creates a private key of the algorithm and size in options
+func generatePrivateKey(options KeyOptions) (crypto.Signer, error) {
+	switch options.Algorithm {
+	case Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(options.Rand)
+		return privateKey, err
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), options.Rand)
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), options.Rand)
+	case ECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), options.Rand)
+	case RSA:
+		bits := options.Bits
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		if bits < MinRSABits {
+			return nil, fmt.Errorf("rsa key of %d bits is too weak, at least %d required", bits, MinRSABits)
+		}
+		privateKey, err := rsa.GenerateKey(options.Rand, bits)
+		if err != nil {
+			return nil, err
+		}
+		// Validate Private Key
+		if err := privateKey.Validate(); err != nil {
+			return nil, err
+		}
+		return privateKey, nil
+	}
+	return nil, fmt.Errorf("unknown key algorithm %q", options.Algorithm)
+}
 
-	return privatePEM
+// encodePrivateKeyToPEM encodes Private Key to PEM in the format native to its type
+func encodePrivateKeyToPEM(privateKey crypto.Signer) ([]byte, error) {
+	var block pem.Block
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		block = pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	return pem.EncodeToMemory(&block), nil
 }
 
-// generatePublicKey take a rsa.PublicKey and return bytes suitable for writing to .pub file
-// returns in the format "ssh-rsa ..."
-func generatePublicKey(privatekey *rsa.PublicKey) ([]byte, error) {
-	publicRsaKey, err := ssh.NewPublicKey(privatekey)
-	if err != nil {
-		return nil, err
+// authorizedKey returns the public key in the format "ssh-rsa AAAA... comment"
+func authorizedKey(publicKey ssh.PublicKey, comment string) string {
+	line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(publicKey)), "\n")
+	if comment != "" {
+		line += " " + comment
 	}
-	pubKeyBytes := ssh.MarshalAuthorizedKey(publicRsaKey)
-	return pubKeyBytes, nil
+	return line
 }
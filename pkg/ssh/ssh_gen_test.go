@@ -1,6 +1,10 @@
 package ssh
 
-import "testing"
+import (
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
 
 func TestGenerateSSHKeys(t *testing.T) {
 	private, public, err := GenerateSSHKeys()
@@ -11,4 +15,48 @@ func TestGenerateSSHKeys(t *testing.T) {
 	if private == "" || public == "" {
 		t.Fatal("some of the keys are empty")
 	}
-}
\ No newline at end of file
+}
+
+func TestGenerateKey(t *testing.T) {
+	cases := []struct {
+		options KeyOptions
+		keyType string
+	}{
+		{KeyOptions{}, ssh.KeyAlgoED25519},
+		{KeyOptions{Algorithm: ECDSAP256}, ssh.KeyAlgoECDSA256},
+		{KeyOptions{Algorithm: ECDSAP384}, ssh.KeyAlgoECDSA384},
+		{KeyOptions{Algorithm: ECDSAP521}, ssh.KeyAlgoECDSA521},
+		{KeyOptions{Algorithm: RSA, Bits: 2048}, ssh.KeyAlgoRSA},
+	}
+	for _, c := range cases {
+		c.options.Comment = "user@host"
+		pair, err := GenerateKey(c.options)
+		if err != nil {
+			t.Fatalf("%s: %s", c.keyType, err)
+		}
+		signer, err := ssh.ParsePrivateKey([]byte(pair.PrivatePEM))
+		if err != nil {
+			t.Fatalf("%s: cannot parse private key: %s", c.keyType, err)
+		}
+		public, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(pair.AuthorizedKey))
+		if err != nil {
+			t.Fatalf("%s: cannot parse authorized key: %s", c.keyType, err)
+		}
+		if public.Type() != c.keyType || comment != "user@host" {
+			t.Fatalf("%s: unexpected authorized key %q", c.keyType, pair.AuthorizedKey)
+		}
+		if ssh.FingerprintSHA256(signer.PublicKey()) != pair.Fingerprint ||
+			!strings.HasPrefix(pair.Fingerprint, "SHA256:") {
+			t.Fatalf("%s: fingerprint %s does not match the private key", c.keyType, pair.Fingerprint)
+		}
+	}
+}
+
+func TestGenerateKeyRejectsWeakRSA(t *testing.T) {
+	if _, err := GenerateKey(KeyOptions{Algorithm: RSA, Bits: 1024}); err == nil {
+		t.Fatal("1024-bit rsa key generated")
+	}
+	if _, err := GenerateKey(KeyOptions{Algorithm: "dsa"}); err == nil {
+		t.Fatal("unknown algorithm accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package tunneling
+
+import (
+	"fmt"
+	"github.com/bifshteks/tough_common/pkg/tunneling/source"
+	"time"
+)
+
+// Decision is the verdict of a Policy about a message
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the rule that made the decision, empty for defaults
+	Rule   string
+	Reason string
+}
+
+var allowed = Decision{Allowed: true}
+
+// Policy controls which messages Transmitter passes between sources
+type Policy interface {
+	// Admit decides whether a message read from the author enters the transmitter
+	// at all. Rejected messages are not delivered to anybody.
+	Admit(author source.Source, msg []byte) Decision
+	// Route decides whether an admitted message is delivered to the recipient.
+	// Denied deliveries are dropped, other recipients still get the message.
+	Route(author source.Source, recipient source.Source, msg []byte) Decision
+}
+
+// Rule matches messages going from sources with From labels to sources
+// with To labels (see source.Labels.Matches)
+type Rule struct {
+	Name  string
+	Allow bool
+	From  source.Labels
+	To    source.Labels
+	// MaxMessageSize limits messages allowed by the rule, 0 means no limit
+	MaxMessageSize int
+}
+
+// RulePolicy applies the first Rule that matches the author and the recipient,
+// falling back to DefaultAllow when no rule matches
+type RulePolicy struct {
+	Rules        []Rule
+	DefaultAllow bool
+	// MaxMessageSize rejects larger messages from anybody, 0 means no limit
+	MaxMessageSize int
+}
+
+func (policy RulePolicy) Admit(author source.Source, msg []byte) Decision {
+	if policy.MaxMessageSize > 0 && len(msg) > policy.MaxMessageSize {
+		return Decision{Reason: fmt.Sprintf(
+			"message of %d bytes exceeds limit of %d", len(msg), policy.MaxMessageSize)}
+	}
+	return allowed
+}
+
+func (policy RulePolicy) Route(author source.Source, recipient source.Source, msg []byte) Decision {
+	from := source.LabelsOf(author)
+	to := source.LabelsOf(recipient)
+	for _, rule := range policy.Rules {
+		if !from.Matches(rule.From) || !to.Matches(rule.To) {
+			continue
+		}
+		if !rule.Allow {
+			return Decision{Rule: rule.Name, Reason: "denied by rule"}
+		}
+		if rule.MaxMessageSize > 0 && len(msg) > rule.MaxMessageSize {
+			return Decision{Rule: rule.Name, Reason: fmt.Sprintf(
+				"message of %d bytes exceeds limit of %d", len(msg), rule.MaxMessageSize)}
+		}
+		return Decision{Allowed: true, Rule: rule.Name}
+	}
+	if !policy.DefaultAllow {
+		return Decision{Reason: "no rule allows it"}
+	}
+	return allowed
+}
+
+// AuditRecord describes a message that was not passed by the Policy, or that
+// its recipient refused as too big (see source.OversizeClose)
+type AuditRecord struct {
+	Time   time.Time
+	From   source.Labels
+	To     source.Labels // nil if the message was rejected by Policy.Admit
+	Size   int
+	Rule   string
+	Reason string
+}
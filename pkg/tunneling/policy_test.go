@@ -0,0 +1,107 @@
+package tunneling
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/bifshteks/tough_common/pkg/tunneling/source"
+	requirement "github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransmitterEnforcesPolicy(t *testing.T) {
+	require := requirement.New(t)
+	agent := NewNormalSourceMock([]string{"from agent", "too long message from agent"})
+	viewer := NewNormalSourceMock([]string{"from viewer"})
+	admin := NewNormalSourceMock([]string{})
+	policy := RulePolicy{
+		Rules: []Rule{
+			{Name: "viewers are read only", Allow: false, From: source.Labels{"role": "viewer"}},
+			{Name: "agents", Allow: true, From: source.Labels{"role": "agent"}, MaxMessageSize: 10},
+		},
+		DefaultAllow: true,
+	}
+	var mx sync.Mutex
+	records := make([]AuditRecord, 0)
+	trans := NewTransmitterWithOptions(TransmitterOptions{
+		Policy: policy,
+		Audit: func(record AuditRecord) {
+			mx.Lock()
+			records = append(records, record)
+			mx.Unlock()
+		},
+	}, logutil.DummyLogger)
+	trans.AddSources(
+		source.WithLabels(agent, source.Labels{"role": "agent"}),
+		source.WithLabels(viewer, source.Labels{"role": "viewer"}),
+		source.WithLabels(admin, source.Labels{"role": "admin"}),
+	)
+	stop := runTransmitter(trans)
+	waitForMessages(t, viewer, "from agent")
+	waitForMessages(t, admin, "from agent")
+	deadline := time.Now().Add(time.Second)
+	for auditedCount(&mx, &records) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+
+	require.False(admin.gotMessage("too long message from agent"), "message over rule limit was delivered")
+	require.False(agent.gotMessage("from viewer"), "denied message was delivered")
+	require.False(admin.gotMessage("from viewer"), "denied message was delivered")
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(records, 4, "every denied delivery must be audited")
+	for _, record := range records {
+		require.NotEmpty(record.Rule)
+		require.NotNil(record.To)
+	}
+}
+
+func TestTransmitterRejectsOversizedMessages(t *testing.T) {
+	require := requirement.New(t)
+	author := NewNormalSourceMock([]string{"0123456789"})
+	recipient := NewNormalSourceMock([]string{})
+	rejected := make(chan AuditRecord, 1)
+	trans := NewTransmitterWithOptions(TransmitterOptions{
+		Policy: RulePolicy{DefaultAllow: true, MaxMessageSize: 4},
+		Audit:  func(record AuditRecord) { rejected <- record },
+	}, logutil.DummyLogger)
+	trans.AddSources(author, recipient)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go trans.Run(ctx, cancel)
+	record := <-rejected
+	require.Nil(record.To, "rejected message has no recipient")
+	require.Equal(10, record.Size)
+	require.False(recipient.gotMessage("0123456789"))
+}
+
+func auditedCount(mx *sync.Mutex, records *[]AuditRecord) int {
+	mx.Lock()
+	defer mx.Unlock()
+	return len(*records)
+}
+
+func TestTransmitterAuditsMessagesRefusedAsTooBig(t *testing.T) {
+	require := requirement.New(t)
+	author := NewNormalSourceMock([]string{"0123456789"})
+	recipient := NewNormalSourceMock([]string{})
+	limited := source.NewSizeLimited(
+		source.WithLabels(recipient, source.Labels{"role": "viewer"}),
+		source.SizeLimit{MaxOutbound: 4, Action: source.OversizeClose}, logutil.DummyLogger,
+	)
+	refused := make(chan AuditRecord, 1)
+	trans := NewTransmitterWithOptions(TransmitterOptions{
+		Audit: func(record AuditRecord) { refused <- record },
+	}, logutil.DummyLogger)
+	trans.AddSources(author, limited)
+
+	stop := runTransmitter(trans)
+	defer stop()
+	record := <-refused
+	require.Equal(source.Labels{"role": "viewer"}, record.To)
+	require.Equal(10, record.Size)
+	require.Empty(recipient.messages())
+}
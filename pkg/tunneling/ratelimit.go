@@ -0,0 +1,166 @@
+package tunneling
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/tunneling/source"
+	"sync"
+	"time"
+)
+
+// TokenBucket lets through rate tokens per second on average and at most
+// burst tokens at once
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	clock source.Clock
+
+	mx     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int, clock source.Clock) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		clock:  clock,
+		tokens: float64(burst),
+		last:   clock.Now(),
+	}
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+}
+
+// TryTake takes n tokens if the bucket has them
+func (bucket *TokenBucket) TryTake(n float64) bool {
+	bucket.mx.Lock()
+	defer bucket.mx.Unlock()
+	bucket.refill(bucket.clock.Now())
+	if bucket.tokens < n {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+// Reserve takes n tokens, going into debt if there are not enough of them,
+// and returns how long the caller has to wait for the debt to be paid
+func (bucket *TokenBucket) Reserve(n float64) (wait time.Duration) {
+	bucket.mx.Lock()
+	defer bucket.mx.Unlock()
+	bucket.refill(bucket.clock.Now())
+	bucket.tokens -= n
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+type OverLimitAction int
+
+const (
+	// OverLimitDelay waits until the message fits the limit. For inbound limits
+	// it stops reading from the source, so the source itself slows down.
+	OverLimitDelay OverLimitAction = iota
+	// OverLimitDrop drops messages that do not fit the limit
+	OverLimitDrop
+)
+
+// Limit configures RateLimiter. Zero rates mean no limit, zero bursts
+// default to one second worth of rate.
+type Limit struct {
+	MessagesPerSecond float64
+	MessageBurst      int
+	BytesPerSecond    float64
+	ByteBurst         int
+	Action            OverLimitAction
+}
+
+// RateLimiter limits both the number of messages and the number of bytes
+type RateLimiter struct {
+	messages *TokenBucket
+	bytes    *TokenBucket
+	action   OverLimitAction
+	clock    source.Clock
+}
+
+func NewRateLimiter(limit Limit, clock source.Clock) *RateLimiter {
+	limiter := &RateLimiter{action: limit.Action, clock: clock}
+	if limit.MessagesPerSecond > 0 {
+		limiter.messages = NewTokenBucket(limit.MessagesPerSecond, burst(limit.MessageBurst, limit.MessagesPerSecond), clock)
+	}
+	if limit.BytesPerSecond > 0 {
+		limiter.bytes = NewTokenBucket(limit.BytesPerSecond, burst(limit.ByteBurst, limit.BytesPerSecond), clock)
+	}
+	return limiter
+}
+
+func burst(configured int, rate float64) int {
+	if configured > 0 {
+		return configured
+	}
+	if rate < 1 {
+		return 1
+	}
+	return int(rate)
+}
+
+// Allow reports whether a message of the given size may pass. With OverLimitDelay
+// it waits for that (returning false only if ctx is done first), with
+// OverLimitDrop it answers immediately.
+func (limiter *RateLimiter) Allow(ctx context.Context, size int) bool {
+	if limiter.action == OverLimitDrop {
+		if limiter.messages != nil && !limiter.messages.TryTake(1) {
+			return false
+		}
+		// message token is not returned if bytes do not fit: a dropped message
+		// still counts, so flooding with big messages is limited as well
+		return limiter.bytes == nil || limiter.bytes.TryTake(float64(size))
+	}
+	var wait time.Duration
+	if limiter.messages != nil {
+		wait = limiter.messages.Reserve(1)
+	}
+	if limiter.bytes != nil {
+		if bytesWait := limiter.bytes.Reserve(float64(size)); bytesWait > wait {
+			wait = bytesWait
+		}
+	}
+	if wait == 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-limiter.clock.After(wait):
+		return true
+	}
+}
+
+// RateLimits configure rate limiting of Transmitter
+type RateLimits struct {
+	// Total limits all messages read by the transmitter together
+	Total *RateLimiter
+	// Inbound returns the limiter for messages read from the source, nil for no limit.
+	// It is called once for every added source.
+	Inbound func(src source.Source) *RateLimiter
+	// Outbound returns the limiter for messages written to the source, nil for no limit.
+	// It is called once for every added source. Note that the transmitter writes
+	// to all sources from a single goroutine, so OverLimitDelay on one recipient
+	// delays the others as well.
+	Outbound func(src source.Source) *RateLimiter
+}
+
+// PerSource returns a function for RateLimits.Inbound/Outbound that gives every
+// source its own limiter with the same limit
+func PerSource(limit Limit, clock source.Clock) func(src source.Source) *RateLimiter {
+	return func(src source.Source) *RateLimiter {
+		return NewRateLimiter(limit, clock)
+	}
+}
@@ -0,0 +1,74 @@
+package tunneling
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/bifshteks/tough_common/pkg/tunneling/source"
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterDropsOverLimit(t *testing.T) {
+	require := requirement.New(t)
+	clock := source.NewFakeClock(time.Unix(0, 0))
+	limiter := NewRateLimiter(Limit{
+		MessagesPerSecond: 2, MessageBurst: 2,
+		BytesPerSecond: 100, ByteBurst: 100,
+		Action: OverLimitDrop,
+	}, clock)
+	ctx := context.Background()
+
+	require.True(limiter.Allow(ctx, 10))
+	require.True(limiter.Allow(ctx, 10))
+	require.False(limiter.Allow(ctx, 10), "message over burst was allowed")
+	clock.Advance(500 * time.Millisecond)
+	require.True(limiter.Allow(ctx, 10), "bucket did not refill")
+	clock.Advance(time.Second)
+	require.False(limiter.Allow(ctx, 101), "message over byte burst was allowed")
+}
+
+func TestRateLimiterDelaysOverLimit(t *testing.T) {
+	require := requirement.New(t)
+	clock := source.NewFakeClock(time.Unix(0, 0))
+	limiter := NewRateLimiter(Limit{BytesPerSecond: 10, ByteBurst: 10}, clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	allowed := make(chan bool)
+
+	require.True(limiter.Allow(ctx, 10))
+	go func() {
+		allowed <- limiter.Allow(ctx, 5)
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(500 * time.Millisecond)
+	require.True(<-allowed)
+
+	go func() {
+		allowed <- limiter.Allow(ctx, 5)
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	require.False(<-allowed, "delayed message was allowed after context cancel")
+}
+
+func TestTransmitterAppliesInboundLimit(t *testing.T) {
+	noisy := NewNormalSourceMock([]string{"1", "2", "3"})
+	quiet := NewNormalSourceMock([]string{})
+	clock := source.NewFakeClock(time.Unix(0, 0))
+	trans := NewTransmitterWithOptions(TransmitterOptions{
+		RateLimits: RateLimits{
+			Inbound: PerSource(Limit{MessagesPerSecond: 1, MessageBurst: 2, Action: OverLimitDrop}, clock),
+		},
+	}, logutil.DummyLogger)
+	trans.AddSources(noisy, quiet)
+
+	stop := runTransmitter(trans)
+	waitForMessages(t, quiet, "1", "2")
+	stop()
+
+	requirement.Equal(t, []string{"1", "2"}, quiet.messages())
+}
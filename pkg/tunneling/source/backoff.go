@@ -0,0 +1,125 @@
+package source
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long retrier waits before the next connection attempt.
+// Implementations must be safe to share between retriers, so all the state
+// they need is passed in: attempt is the number of the failed attempt (starting from 1)
+// and previous is the delay returned for the previous attempt (0 for the first one).
+type Backoff interface {
+	Next(attempt int, previous time.Duration) (delay time.Duration)
+}
+
+// BackoffFunc is an adapter to use ordinary functions as Backoff
+type BackoffFunc func(attempt int, previous time.Duration) time.Duration
+
+func (f BackoffFunc) Next(attempt int, previous time.Duration) time.Duration {
+	return f(attempt, previous)
+}
+
+func jitter(jitterFunc func() float64) float64 {
+	if jitterFunc == nil {
+		return 1
+	}
+	return jitterFunc()
+}
+
+func scale(d time.Duration, factor float64) time.Duration {
+	return time.Duration(float64(d) * factor)
+}
+
+// maxDelay caps the delays of backoffs without a limit, which would overflow
+// after enough attempts otherwise
+const maxDelay = time.Duration(math.MaxInt64)
+
+// capDelay converts delay to a Duration not greater than max, maxDelay if max is 0
+func capDelay(delay float64, max time.Duration) time.Duration {
+	if max <= 0 {
+		max = maxDelay
+	}
+	if delay >= float64(max) {
+		return max
+	}
+	return time.Duration(delay)
+}
+
+// ConstantBackoff waits the same Delay (multiplied by jitter) before every attempt
+type ConstantBackoff struct {
+	Delay time.Duration
+	// JitterFunc is optional, see RetryPolicy.JitterFunc
+	JitterFunc func() float64
+}
+
+func (b ConstantBackoff) Next(attempt int, previous time.Duration) time.Duration {
+	return scale(b.Delay, jitter(b.JitterFunc))
+}
+
+// LinearBackoff increases the delay by Step (multiplied by jitter) after every attempt,
+// never letting it grow past Max by more than one jitter second.
+// It is the behaviour RetryPolicy had before Backoff was introduced.
+type LinearBackoff struct {
+	Step time.Duration
+	// Max is the delay limit, 0 means no limit
+	Max time.Duration
+	// JitterFunc is optional, see RetryPolicy.JitterFunc
+	JitterFunc func() float64
+}
+
+func (b LinearBackoff) Next(attempt int, previous time.Duration) time.Duration {
+	j := jitter(b.JitterFunc)
+	next := previous + scale(b.Step, j)
+	if b.Max > 0 && next > b.Max {
+		return b.Max + scale(time.Second, j)
+	}
+	return next
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after every attempt:
+// Initial, Initial*Multiplier, Initial*Multiplier^2, ... capped by Max.
+// Jitter is applied to the result and not accumulated.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	// Max is the delay limit, 0 means no limit but the largest Duration
+	Max time.Duration
+	// Multiplier defaults to 2 if not greater than 1
+	Multiplier float64
+	// JitterFunc is optional, see RetryPolicy.JitterFunc
+	JitterFunc func() float64
+}
+
+func (b ExponentialBackoff) Next(attempt int, previous time.Duration) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := capDelay(float64(b.Initial)*math.Pow(multiplier, float64(attempt-1)), b.Max)
+	return capDelay(float64(delay)*jitter(b.JitterFunc), 0)
+}
+
+// DecorrelatedJitterBackoff picks the delay randomly between Base and three times
+// the previous delay, capped by Max (see "Exponential Backoff And Jitter" on AWS
+// architecture blog). It spreads reconnections of many clients better than
+// multiplying by jitter.
+type DecorrelatedJitterBackoff struct {
+	Base time.Duration
+	// Max is the delay limit, 0 means no limit but the largest Duration
+	Max time.Duration
+	// RandFunc returns a number in [0, 1), rand.Float64 is used if nil
+	RandFunc func() float64
+}
+
+func (b DecorrelatedJitterBackoff) Next(attempt int, previous time.Duration) time.Duration {
+	randFunc := b.RandFunc
+	if randFunc == nil {
+		randFunc = rand.Float64
+	}
+	upper := math.Max(3*float64(previous), float64(b.Base))
+	return capDelay(float64(b.Base)+(upper-float64(b.Base))*randFunc(), b.Max)
+}
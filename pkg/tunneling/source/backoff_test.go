@@ -0,0 +1,75 @@
+package source
+
+import (
+	requirement "github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func delays(backoff Backoff, n int) []time.Duration {
+	result := make([]time.Duration, 0, n)
+	var previous time.Duration
+	for attempt := 1; attempt <= n; attempt++ {
+		previous = backoff.Next(attempt, previous)
+		result = append(result, previous)
+	}
+	return result
+}
+
+func TestConstantBackoff(t *testing.T) {
+	require := requirement.New(t)
+	backoff := ConstantBackoff{Delay: time.Second}
+	require.Equal([]time.Duration{time.Second, time.Second, time.Second}, delays(backoff, 3))
+}
+
+func TestLinearBackoffIsDefaultPolicyBehaviour(t *testing.T) {
+	require := requirement.New(t)
+	policy := RetryPolicy{Delay: 2, MaxTimeout: 5, JitterFunc: func() float64 { return 1 }}
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 6 * time.Second, 6 * time.Second}
+	require.Equal(expected, delays(policy.backoff(), 4))
+}
+
+func TestLinearBackoffWithoutLimit(t *testing.T) {
+	require := requirement.New(t)
+	policy := RetryPolicy{Delay: 1, MaxTimeout: math.Inf(1)}
+	require.Equal(100*time.Second, delays(policy.backoff(), 100)[99])
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	require := requirement.New(t)
+	backoff := ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second,
+	}
+	require.Equal(expected, delays(backoff, 5))
+}
+
+func TestDecorrelatedJitterBackoffStaysInBounds(t *testing.T) {
+	require := requirement.New(t)
+	backoff := DecorrelatedJitterBackoff{Base: time.Second, Max: 30 * time.Second}
+	var previous time.Duration
+	for attempt := 1; attempt <= 1000; attempt++ {
+		next := backoff.Next(attempt, previous)
+		require.GreaterOrEqual(int64(next), int64(time.Second))
+		require.LessOrEqual(int64(next), int64(30*time.Second))
+		if previous > 0 {
+			require.LessOrEqual(int64(next), int64(3*previous))
+		}
+		previous = next
+	}
+}
+
+func TestBackoffWithoutMaxDoesNotOverflow(t *testing.T) {
+	require := requirement.New(t)
+	exponential := ExponentialBackoff{Initial: time.Second, JitterFunc: func() float64 { return 1.5 }}
+	for _, delay := range delays(exponential, 200) {
+		require.Greater(int64(delay), int64(0))
+	}
+	require.Equal(maxDelay, exponential.Next(200, 0))
+
+	decorrelated := DecorrelatedJitterBackoff{Base: time.Second, RandFunc: func() float64 { return 0.999 }}
+	for _, delay := range delays(decorrelated, 200) {
+		require.Greater(int64(delay), int64(0))
+	}
+}
@@ -0,0 +1,141 @@
+package source
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when connecting is not allowed by a CircuitBreaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type BreakerState int
+
+const (
+	// BreakerClosed lets every attempt through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects attempts until its timeout passes
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probe attempts through,
+	// their outcome decides whether the breaker closes or opens again
+	BreakerHalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops connection attempts to a target after Threshold failures
+// within Window, letting probes through again after OpenFor.
+// It is safe to share one breaker between retriers connecting to the same target.
+type CircuitBreaker struct {
+	threshold int
+	window    time.Duration
+	openFor   time.Duration
+	probes    int
+	clock     Clock
+
+	mx             sync.Mutex
+	state          BreakerState
+	failures       []time.Time
+	openedAt       time.Time
+	probesInFlight int
+}
+
+// NewCircuitBreaker creates a breaker that opens after threshold failures within
+// window and lets halfOpenProbes attempts through once it was open for openFor
+func NewCircuitBreaker(threshold int, window time.Duration, openFor time.Duration, halfOpenProbes int, clock Clock) *CircuitBreaker {
+	if halfOpenProbes < 1 {
+		halfOpenProbes = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		openFor:   openFor,
+		probes:    halfOpenProbes,
+		clock:     clock,
+		failures:  make([]time.Time, 0, threshold),
+	}
+}
+
+func (breaker *CircuitBreaker) State() BreakerState {
+	breaker.mx.Lock()
+	defer breaker.mx.Unlock()
+	return breaker.state
+}
+
+// Allow reports whether an attempt may be made now. If it may not,
+// retryIn tells when it is worth asking again
+func (breaker *CircuitBreaker) Allow() (allowed bool, retryIn time.Duration) {
+	breaker.mx.Lock()
+	defer breaker.mx.Unlock()
+	switch breaker.state {
+	case BreakerOpen:
+		openTime := breaker.clock.Now().Sub(breaker.openedAt)
+		if openTime < breaker.openFor {
+			return false, breaker.openFor - openTime
+		}
+		breaker.state = BreakerHalfOpen
+		breaker.probesInFlight = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if breaker.probesInFlight >= breaker.probes {
+			return false, breaker.openFor
+		}
+		breaker.probesInFlight++
+	}
+	return true, 0
+}
+
+// Release gives back the probe taken by Allow for an attempt that is not made
+// after all. Without it a half-open breaker would wait forever for its outcome.
+func (breaker *CircuitBreaker) Release() {
+	breaker.mx.Lock()
+	defer breaker.mx.Unlock()
+	if breaker.state == BreakerHalfOpen && breaker.probesInFlight > 0 {
+		breaker.probesInFlight--
+	}
+}
+
+// Success records a successful attempt, closing the breaker
+func (breaker *CircuitBreaker) Success() {
+	breaker.mx.Lock()
+	defer breaker.mx.Unlock()
+	breaker.state = BreakerClosed
+	breaker.failures = breaker.failures[:0]
+}
+
+// Failure records a failed attempt, opening the breaker if needed
+func (breaker *CircuitBreaker) Failure() {
+	breaker.mx.Lock()
+	defer breaker.mx.Unlock()
+	now := breaker.clock.Now()
+	if breaker.state == BreakerHalfOpen {
+		breaker.open(now)
+		return
+	}
+	recent := breaker.failures[:0]
+	for _, at := range breaker.failures {
+		if now.Sub(at) < breaker.window {
+			recent = append(recent, at)
+		}
+	}
+	breaker.failures = append(recent, now)
+	if len(breaker.failures) >= breaker.threshold {
+		breaker.open(now)
+	}
+}
+
+func (breaker *CircuitBreaker) open(now time.Time) {
+	breaker.state = BreakerOpen
+	breaker.openedAt = now
+	breaker.failures = breaker.failures[:0]
+}
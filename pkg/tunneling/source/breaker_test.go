@@ -0,0 +1,86 @@
+package source
+
+import (
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpensAfterThresholdWithinWindow(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	breaker := NewCircuitBreaker(3, time.Minute, 30*time.Second, 1, clock)
+
+	breaker.Failure()
+	breaker.Failure()
+	clock.Advance(2 * time.Minute) // first failures are out of window now
+	breaker.Failure()
+	require.Equal(BreakerClosed, breaker.State())
+
+	breaker.Failure()
+	breaker.Failure()
+	require.Equal(BreakerOpen, breaker.State())
+	allowed, retryIn := breaker.Allow()
+	require.False(allowed)
+	require.Equal(30*time.Second, retryIn)
+}
+
+func TestCircuitBreakerHalfOpenProbes(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	breaker := NewCircuitBreaker(1, time.Minute, 30*time.Second, 1, clock)
+	breaker.Failure()
+
+	clock.Advance(30 * time.Second)
+	allowed, _ := breaker.Allow()
+	require.True(allowed, "probe is not allowed")
+	require.Equal(BreakerHalfOpen, breaker.State())
+	allowed, _ = breaker.Allow()
+	require.False(allowed, "more probes than configured are allowed")
+
+	breaker.Failure()
+	require.Equal(BreakerOpen, breaker.State(), "failed probe did not open breaker")
+
+	clock.Advance(30 * time.Second)
+	allowed, _ = breaker.Allow()
+	require.True(allowed)
+	breaker.Success()
+	require.Equal(BreakerClosed, breaker.State(), "successful probe did not close breaker")
+}
+
+func TestRetryBudgetRefills(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	budget := NewRetryBudget(2, 10*time.Second, clock)
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := budget.Withdraw()
+		require.True(allowed)
+	}
+	allowed, retryIn := budget.Withdraw()
+	require.False(allowed)
+	require.Equal(10*time.Second, retryIn)
+
+	clock.Advance(10 * time.Second)
+	allowed, _ = budget.Withdraw()
+	require.True(allowed, "budget did not refill")
+}
+
+func TestRetrierReleasesProbeDeniedByBudget(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	breaker := NewCircuitBreaker(1, time.Minute, 30*time.Second, 1, clock)
+	budget := NewRetryBudget(0, 0, clock)
+	policy := RetryPolicy{Breaker: breaker, Budget: budget}
+	retrier := NewRetrierWithClock(NewNetworkSourceMock(0), policy, clock, logutil.DummyLogger)
+	breaker.Failure()
+	clock.Advance(30 * time.Second)
+
+	allowed, _, err := retrier.admit(true)
+	require.False(allowed)
+	require.Error(err, "exhausted budget is not reported")
+	require.Equal(BreakerHalfOpen, breaker.State())
+	allowed, _ = breaker.Allow()
+	require.True(allowed, "probe denied by the budget was not given back to the breaker")
+}
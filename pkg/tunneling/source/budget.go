@@ -0,0 +1,52 @@
+package source
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget limits how many retries all the retriers sharing it may make:
+// it holds up to Max retries and gets one more every Every.
+// First attempts to connect are not counted, only the repeated ones.
+type RetryBudget struct {
+	max   float64
+	every time.Duration
+	clock Clock
+
+	mx       sync.Mutex
+	tokens   float64
+	refilled time.Time
+}
+
+func NewRetryBudget(max int, every time.Duration, clock Clock) *RetryBudget {
+	return &RetryBudget{
+		max:      float64(max),
+		every:    every,
+		clock:    clock,
+		tokens:   float64(max),
+		refilled: clock.Now(),
+	}
+}
+
+// Withdraw takes one retry from the budget. If the budget is exhausted,
+// retryIn tells when the next retry will be available
+func (budget *RetryBudget) Withdraw() (allowed bool, retryIn time.Duration) {
+	budget.mx.Lock()
+	defer budget.mx.Unlock()
+	now := budget.clock.Now()
+	if budget.every > 0 {
+		budget.tokens += float64(now.Sub(budget.refilled)) / float64(budget.every)
+		if budget.tokens > budget.max {
+			budget.tokens = budget.max
+		}
+	}
+	budget.refilled = now
+	if budget.tokens >= 1 {
+		budget.tokens--
+		return true, 0
+	}
+	if budget.every <= 0 {
+		return false, 0
+	}
+	return false, time.Duration((1 - budget.tokens) * float64(budget.every))
+}
@@ -0,0 +1,97 @@
+package source
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type FailureClass int
+
+const (
+	// FailureRetryable means that connecting again may succeed
+	FailureRetryable FailureClass = iota
+	// FailureFatal means that there is no point in connecting again
+	FailureFatal
+	// FailureRateLimited means that the server asked us to slow down,
+	// Classification.RetryAfter tells for how long if the server said so
+	FailureRateLimited
+)
+
+func (class FailureClass) String() string {
+	switch class {
+	case FailureRetryable:
+		return "retryable"
+	case FailureFatal:
+		return "fatal"
+	case FailureRateLimited:
+		return "rate limited"
+	}
+	return "unknown"
+}
+
+type Classification struct {
+	Class FailureClass
+	// RetryAfter is the minimal delay before the next attempt, 0 if not known
+	RetryAfter time.Duration
+}
+
+// Classifier decides how retrier treats a connect failure.
+// statusCode is the status of ws handshake response, 0 if there was no response
+type Classifier interface {
+	Classify(err error, statusCode int) Classification
+}
+
+// ClassifierFunc is an adapter to use ordinary functions as Classifier
+type ClassifierFunc func(err error, statusCode int) Classification
+
+func (f ClassifierFunc) Classify(err error, statusCode int) Classification {
+	return f(err, statusCode)
+}
+
+// DefaultClassifier is the classifier of NewDefaultClassifier with RealClock
+var DefaultClassifier = NewDefaultClassifier(RealClock)
+
+// NewDefaultClassifier returns a classifier that treats FatalConnectError as fatal,
+// 429 and 503 responses as rate limiting (honouring Retry-After header, dates of
+// which are compared with clock) and everything else as retryable
+func NewDefaultClassifier(clock Clock) Classifier {
+	return ClassifierFunc(func(err error, statusCode int) Classification {
+		if IsFatal(err) {
+			return Classification{Class: FailureFatal}
+		}
+		if statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable {
+			return Classification{Class: FailureRateLimited, RetryAfter: RetryAfter(err, clock.Now())}
+		}
+		return Classification{Class: FailureRetryable}
+	})
+}
+
+// RetryAfter returns the delay requested by Retry-After header of the handshake
+// response wrapped in err, 0 if there is no such header
+func RetryAfter(err error, now time.Time) time.Duration {
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) || handshakeErr.Header == nil {
+		return 0
+	}
+	return parseRetryAfter(handshakeErr.Header.Get("Retry-After"), now)
+}
+
+// parseRetryAfter parses both forms of Retry-After: delay in seconds and http date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	at, err := http.ParseTime(value)
+	if err != nil || !at.After(now) {
+		return 0
+	}
+	return at.Sub(now)
+}
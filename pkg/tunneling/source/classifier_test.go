@@ -0,0 +1,84 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func handshakeError(status int, retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return NewConnectError("ws://example", NewHandshakeError(status, header))
+}
+
+func TestDefaultClassifier(t *testing.T) {
+	require := requirement.New(t)
+	cases := []struct {
+		err   error
+		class FailureClass
+	}{
+		{NewConnectError("u", errors.New("refused")), FailureRetryable},
+		{NewFatalConnectError(handshakeError(http.StatusUnauthorized, "")), FailureFatal},
+		{handshakeError(http.StatusTooManyRequests, "5"), FailureRateLimited},
+		{handshakeError(http.StatusServiceUnavailable, ""), FailureRateLimited},
+		{handshakeError(http.StatusBadGateway, ""), FailureRetryable},
+	}
+	for _, c := range cases {
+		classification := DefaultClassifier.Classify(c.err, StatusCode(c.err))
+		require.Equal(c.class, classification.Class, "class of %v", c.err)
+	}
+}
+
+func TestRetryAfterParsesSecondsAndDate(t *testing.T) {
+	require := requirement.New(t)
+	now := time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	require.Equal(5*time.Second, RetryAfter(handshakeError(429, "5"), now))
+	date := now.Add(time.Minute).Format(http.TimeFormat)
+	require.Equal(time.Minute, RetryAfter(handshakeError(503, date), now))
+	require.Equal(time.Duration(0), RetryAfter(handshakeError(503, "garbage"), now))
+	require.Equal(time.Duration(0), RetryAfter(errors.New("no response"), now))
+}
+
+func TestRetrierHonoursRetryAfter(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(1)
+	src.connectErr = handshakeError(http.StatusTooManyRequests, "120")
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	done := make(chan error)
+
+	go func() {
+		done <- retrier.Connect(context.Background())
+	}()
+	waitForWaiters(t, clock, 1)
+	at, _ := retrier.NextAttempt()
+	require.Equal(clock.Now().Add(120*time.Second), at, "Retry-After is longer than backoff and must win")
+	clock.Advance(120 * time.Second)
+	require.NoError(<-done)
+}
+
+func TestRetrierWrapsErrorsClassifiedAsFatal(t *testing.T) {
+	policy := constantPolicy
+	policy.Classifier = ClassifierFunc(func(err error, statusCode int) Classification {
+		return Classification{Class: FailureFatal}
+	})
+	retrier := NewRetrier(NewNetworkSourceMock(1), policy, logutil.DummyLogger)
+
+	err := retrier.Connect(context.Background())
+	requirement.True(t, IsFatal(err), "error classified as fatal is not reported as fatal")
+}
+
+func TestDefaultClassifierUsesClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC))
+	date := clock.Now().Add(time.Minute).Format(http.TimeFormat)
+	classification := NewDefaultClassifier(clock).Classify(handshakeError(503, date), 503)
+	requirement.Equal(t, time.Minute, classification.RetryAfter)
+}
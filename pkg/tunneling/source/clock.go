@@ -0,0 +1,84 @@
+package source
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for retrier, so that delays can be controlled in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RealClock is a Clock backed by package time
+var RealClock Clock = realClock{}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// FakeClock is a Clock that only moves when Advance is called
+type FakeClock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	ch := make(chan time.Time, 1)
+	at := clock.now.Add(d)
+	if d <= 0 {
+		ch <- at
+		return ch
+	}
+	clock.timers = append(clock.timers, fakeTimer{at: at, ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward and fires every timer that is due
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	clock.now = clock.now.Add(d)
+	pending := clock.timers[:0]
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- clock.now
+	}
+	clock.timers = pending
+}
+
+// Waiters returns the number of timers that have not fired yet.
+// Tests use it to find out that the code under test started waiting.
+func (clock *FakeClock) Waiters() int {
+	clock.mx.Lock()
+	defer clock.mx.Unlock()
+	return len(clock.timers)
+}
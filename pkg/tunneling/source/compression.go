@@ -0,0 +1,373 @@
+package source
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec compresses messages. ID is written in front of every message compressed
+// with the codec, so it must be the same on both ends and unique among codecs.
+// IDs 0, 0xFE and 0xFF are reserved (see FlagRaw, FlagHelloReply and FlagHello),
+// IDs of the codecs of this package are 1 to 4. Other codecs can be plugged in
+// with other IDs.
+//
+// The standard library has only DEFLATE based codecs, SnappyCodec and ZstdCodec
+// use github.com/klauspost/compress, a pure Go implementation of both formats
+// without dependencies of its own.
+type Codec interface {
+	ID() byte
+	Compress(msg []byte) ([]byte, error)
+	// Decompress must not produce more than maxSize bytes
+	Decompress(msg []byte, maxSize int64) ([]byte, error)
+}
+
+// Message flags (first byte of every message sent by Compressed) that are not
+// codec IDs, codecs cannot use them
+const (
+	// FlagRaw flags messages sent uncompressed
+	FlagRaw byte = 0
+	// FlagHello flags the announcement of the codecs supported, which the peer
+	// answers with its own announcement flagged FlagHelloReply
+	FlagHello byte = 0xFF
+	// FlagHelloReply flags the announcement answering FlagHello
+	FlagHelloReply byte = 0xFE
+)
+
+// FlateCodec compresses messages with raw DEFLATE
+type FlateCodec struct {
+	// Level is one of compress/flate levels, 0 means flate.DefaultCompression
+	Level int
+}
+
+func (codec FlateCodec) ID() byte {
+	return 1
+}
+
+func (codec FlateCodec) Compress(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level(codec.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finishCompression(&buf, w, msg)
+}
+
+func (codec FlateCodec) Decompress(msg []byte, maxSize int64) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(msg))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// GzipCodec compresses messages with gzip, which costs a header and a checksum
+// per message compared to FlateCodec
+type GzipCodec struct {
+	// Level is one of compress/gzip levels, 0 means gzip.DefaultCompression
+	Level int
+}
+
+func (codec GzipCodec) ID() byte {
+	return 2
+}
+
+func (codec GzipCodec) Compress(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level(codec.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finishCompression(&buf, w, msg)
+}
+
+func (codec GzipCodec) Decompress(msg []byte, maxSize int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// SnappyCodec compresses messages in Snappy block format: much faster than
+// DEFLATE but compressing less, it suits fast links
+type SnappyCodec struct{}
+
+func (codec SnappyCodec) ID() byte {
+	return 3
+}
+
+func (codec SnappyCodec) Compress(msg []byte) ([]byte, error) {
+	return s2.EncodeSnappy(nil, msg), nil
+}
+
+func (codec SnappyCodec) Decompress(msg []byte, maxSize int64) ([]byte, error) {
+	// the block starts with its decoded length, no need to decode bombs
+	size, err := s2.DecodedLen(msg)
+	if err != nil {
+		return nil, err
+	}
+	if int64(size) > maxSize {
+		return nil, fmt.Errorf("%w: decompressed message exceeds %d bytes", ErrMessageTooBig, maxSize)
+	}
+	return s2.Decode(nil, msg)
+}
+
+// ZstdCodec compresses messages with Zstandard, which compresses better than
+// DEFLATE at a similar speed
+type ZstdCodec struct {
+	// Level is a zstd level (1 to 22), 0 means the default level of the encoder
+	Level int
+}
+
+func (codec ZstdCodec) ID() byte {
+	return 4
+}
+
+func (codec ZstdCodec) Compress(msg []byte) ([]byte, error) {
+	options := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if codec.Level != 0 {
+		options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(codec.Level)))
+	}
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf, options...)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompression(&buf, w, msg)
+}
+
+func (codec ZstdCodec) Decompress(msg []byte, maxSize int64) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(msg), zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+func level(configured int) int {
+	if configured == 0 {
+		return flate.DefaultCompression
+	}
+	return configured
+}
+
+func finishCompression(buf *bytes.Buffer, w io.WriteCloser, msg []byte) ([]byte, error) {
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	msg, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(msg)) > maxSize {
+		return nil, fmt.Errorf("%w: decompressed message exceeds %d bytes", ErrMessageTooBig, maxSize)
+	}
+	return msg, nil
+}
+
+// DefaultMaxDecompressedSize is used when CompressionOptions.MaxDecompressedSize is not set
+const DefaultMaxDecompressedSize = 16 << 20
+
+type CompressionOptions struct {
+	// Codecs are the codecs this end supports, in order of preference
+	Codecs []Codec
+	// MinSize is the size below which messages are not compressed
+	MinSize int
+	// MaxDecompressedSize protects from decompression bombs
+	MaxDecompressedSize int64
+}
+
+// Compressed is a Source that compresses messages written to the wrapped source
+// and decompresses messages read from it. Both ends of the wrapped connection
+// must be Compressed: on Consume (and on every connection of a ConnectNotifier
+// source) each end announces the codecs it supports, the peer answers with its
+// codecs, and both start compressing once they know which codecs the other end
+// supports. Every message is flagged with the codec used, so messages that do
+// not get smaller are sent as they are, and framed, so that stream sources
+// can be wrapped as well.
+type Compressed struct {
+	Source
+	options CompressionOptions
+	reader  chan []byte
+	frames  deframer
+	logger  *logrus.Logger
+
+	mx    sync.Mutex
+	codec Codec // chosen for writing, nil until the peer says hello
+	// writeMx keeps the frames whole on stream sources, the hello reply is
+	// written while Write may be called
+	writeMx sync.Mutex
+}
+
+// NewCompressed wraps src. It fails if a codec uses a reserved ID or the ID of
+// another codec.
+func NewCompressed(src Source, options CompressionOptions, logger *logrus.Logger) (*Compressed, error) {
+	seen := make(map[byte]bool)
+	for _, codec := range options.Codecs {
+		id := codec.ID()
+		if id == FlagRaw || id == FlagHello || id == FlagHelloReply {
+			return nil, fmt.Errorf("codec %T uses reserved id %d", codec, id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("codec %T uses id %d of another codec", codec, id)
+		}
+		seen[id] = true
+	}
+	if options.MaxDecompressedSize <= 0 {
+		options.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+	compressed := &Compressed{
+		Source:  src,
+		options: options,
+		reader:  make(chan []byte),
+		logger:  logger,
+	}
+	if notifier, ok := src.(ConnectNotifier); ok {
+		notifier.OnConnect(compressed.onConnect)
+	}
+	return compressed, nil
+}
+
+func (compressed *Compressed) GetReader() chan []byte {
+	return compressed.reader
+}
+
+// Labels passes through the labels of the wrapped source
+func (compressed *Compressed) Labels() Labels {
+	return LabelsOf(compressed.Source)
+}
+
+// Codec returns the codec negotiated for writing, nil if messages are sent uncompressed
+func (compressed *Compressed) Codec() Codec {
+	compressed.mx.Lock()
+	defer compressed.mx.Unlock()
+	return compressed.codec
+}
+
+// hello returns the framed announcement of our codecs
+func (compressed *Compressed) hello(flag byte) []byte {
+	hello := []byte{flag}
+	for _, codec := range compressed.options.Codecs {
+		hello = append(hello, codec.ID())
+	}
+	return frame(hello)
+}
+
+// onConnect starts over on a new connection of the wrapped source
+func (compressed *Compressed) onConnect() []byte {
+	compressed.frames.reset()
+	return compressed.hello(FlagHello)
+}
+
+// Consume announces our codecs, unless the wrapped source is a ConnectNotifier
+// doing it on connect, and reads from the wrapped source. It ends with
+// ErrBrokenFrame if the frames cannot be told apart, messages that cannot be
+// decoded are dropped.
+func (compressed *Compressed) Consume(ctx context.Context) error {
+	if _, ok := compressed.Source.(ConnectNotifier); !ok {
+		if err := compressed.write(compressed.hello(FlagHello)); err != nil {
+			return err
+		}
+	}
+	return consumeThrough(ctx, compressed.Source, compressed.reader, func(chunk []byte) ([][]byte, error) {
+		frames, err := compressed.frames.feed(chunk)
+		var msgs [][]byte
+		for _, msg := range frames {
+			decoded, err := compressed.decode(msg)
+			if err != nil {
+				// one broken message is no reason to end the stream
+				compressed.logger.Errorf("dropping message that cannot be decoded: %s", err)
+				continue
+			}
+			msgs = append(msgs, decoded...)
+		}
+		return msgs, err
+	}, func(err error) {
+		compressed.logger.Errorf("compressed source is closing: %s", err)
+	})
+}
+
+func (compressed *Compressed) decode(msg []byte) ([][]byte, error) {
+	if len(msg) == 0 {
+		return nil, errors.New("message without compression flag")
+	}
+	flag, payload := msg[0], msg[1:]
+	switch flag {
+	case FlagRaw:
+		return [][]byte{payload}, nil
+	case FlagHello:
+		compressed.choose(payload)
+		if err := compressed.write(compressed.hello(FlagHelloReply)); err != nil {
+			compressed.logger.Errorf("cannot answer compression hello: %s", err)
+		}
+		return nil, nil
+	case FlagHelloReply:
+		compressed.choose(payload)
+		return nil, nil
+	}
+	for _, codec := range compressed.options.Codecs {
+		if codec.ID() == flag {
+			decompressed, err := codec.Decompress(payload, compressed.options.MaxDecompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			return [][]byte{decompressed}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression codec %d", flag)
+}
+
+// choose picks our most preferred codec that the peer supports
+func (compressed *Compressed) choose(peerCodecs []byte) {
+	compressed.mx.Lock()
+	defer compressed.mx.Unlock()
+	compressed.codec = nil
+	for _, codec := range compressed.options.Codecs {
+		if bytes.IndexByte(peerCodecs, codec.ID()) >= 0 {
+			compressed.codec = codec
+			break
+		}
+	}
+	compressed.logger.Debugf("compression negotiated: %v", compressed.codec)
+}
+
+func (compressed *Compressed) Write(msg []byte) error {
+	return compressed.write(frame(compressed.encode(msg)))
+}
+
+func (compressed *Compressed) write(framed []byte) error {
+	compressed.writeMx.Lock()
+	defer compressed.writeMx.Unlock()
+	return compressed.Source.Write(framed)
+}
+
+func (compressed *Compressed) encode(msg []byte) []byte {
+	codec := compressed.Codec()
+	if codec != nil && len(msg) >= compressed.options.MinSize {
+		payload, err := codec.Compress(msg)
+		if err == nil && len(payload) < len(msg) {
+			return append([]byte{codec.ID()}, payload...)
+		}
+		if err != nil {
+			compressed.logger.Errorf("cannot compress message: %s", err)
+		}
+	}
+	return append([]byte{FlagRaw}, msg...)
+}
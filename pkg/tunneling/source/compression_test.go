@@ -0,0 +1,175 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func jsonPayload(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, `{"level":"info","seq":%d,"msg":"tunnel is alive"}`+"\n", i)
+	}
+	return buf.Bytes()[:size]
+}
+
+func randomPayload(size int) []byte {
+	payload := make([]byte, size)
+	_, _ = rand.Read(payload)
+	return payload
+}
+
+func newCompressed(t *testing.T, src Source, options CompressionOptions) *Compressed {
+	compressed, err := NewCompressed(src, options, logutil.DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func TestCompressedNegotiatesAndRoundTrips(t *testing.T) {
+	require := requirement.New(t)
+	a, b := newPipe()
+	a.chunk, b.chunk = 100, 7 // as stream sources do
+	options := CompressionOptions{Codecs: []Codec{FlateCodec{}, GzipCodec{}}, MinSize: 64}
+	left := newCompressed(t, a, options)
+	right := newCompressed(t, b, CompressionOptions{Codecs: []Codec{GzipCodec{}}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = left.Consume(ctx) }()
+	go func() { _ = right.Consume(ctx) }()
+	deadline := time.Now().Add(time.Second)
+	for (left.Codec() == nil || right.Codec() == nil) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(GzipCodec{}.ID(), left.Codec().ID(), "codec supported by both ends must be chosen")
+
+	for _, payload := range [][]byte{jsonPayload(4096), randomPayload(4096), []byte("short")} {
+		require.NoError(left.Write(payload))
+		require.Equal(payload, <-right.GetReader())
+	}
+}
+
+func TestCompressedSendsIncompressibleMessagesRaw(t *testing.T) {
+	require := requirement.New(t)
+	compressed := newCompressed(t, nil, CompressionOptions{Codecs: []Codec{FlateCodec{}}})
+	compressed.choose([]byte{FlateCodec{}.ID()})
+
+	require.Equal(FlagRaw, compressed.encode(randomPayload(1024))[0])
+	require.Equal(FlateCodec{}.ID(), compressed.encode(jsonPayload(1024))[0])
+}
+
+func TestCodecsRoundTripAndRefuseDecompressionBombs(t *testing.T) {
+	require := requirement.New(t)
+	for _, codec := range []Codec{FlateCodec{}, GzipCodec{}, SnappyCodec{}, ZstdCodec{}} {
+		compressed := newCompressed(t, nil, CompressionOptions{Codecs: []Codec{codec}, MaxDecompressedSize: 1024})
+		compressed.choose([]byte{codec.ID()})
+
+		payload := jsonPayload(1024)
+		encoded := compressed.encode(payload)
+		require.Equal(codec.ID(), encoded[0], "%T did not compress", codec)
+		decoded, err := compressed.decode(encoded)
+		require.NoError(err)
+		require.Equal([][]byte{payload}, decoded, "%T", codec)
+
+		_, err = compressed.decode(compressed.encode(make([]byte, 1<<20)))
+		require.ErrorIs(err, ErrMessageTooBig, "%T", codec)
+	}
+}
+
+func TestCompressedRejectsReservedAndDuplicateCodecIDs(t *testing.T) {
+	require := requirement.New(t)
+	for _, codecs := range [][]Codec{
+		{codecWithID(FlagRaw)}, {codecWithID(FlagHello)}, {codecWithID(FlagHelloReply)}, {FlateCodec{}, codecWithID(FlateCodec{}.ID())},
+	} {
+		_, err := NewCompressed(nil, CompressionOptions{Codecs: codecs}, logutil.DummyLogger)
+		require.Error(err, "codec ids %d accepted", codecs[len(codecs)-1].ID())
+	}
+}
+
+type codecWithID byte
+
+func (codec codecWithID) ID() byte                                       { return byte(codec) }
+func (codec codecWithID) Compress(msg []byte) ([]byte, error)            { return msg, nil }
+func (codec codecWithID) Decompress(msg []byte, _ int64) ([]byte, error) { return msg, nil }
+
+func TestCompressedDropsMessagesThatCannotBeDecoded(t *testing.T) {
+	require := requirement.New(t)
+	a, b := newPipe()
+	right := newCompressed(t, b, CompressionOptions{Codecs: []Codec{FlateCodec{}}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = right.Consume(ctx) }()
+	<-a.GetReader() // hello of right
+
+	require.NoError(a.Write(frame([]byte{FlateCodec{}.ID(), 0xde, 0xad})))
+	require.NoError(a.Write(frame([]byte{42, 'x'})))
+	require.NoError(a.Write(frame(append([]byte{FlagRaw}, "still alive"...))))
+	require.Equal("still alive", string(<-right.GetReader()))
+}
+
+func TestCompressedSaysHelloOnEveryConnection(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(0, NewReadError("mock", errors.New("connection reset")))
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	compressed := newCompressed(t, NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger),
+		CompressionOptions{Codecs: []Codec{GzipCodec{}}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = compressed.Consume(ctx) }()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for len(src.Written()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	hello := string(frame([]byte{FlagHello, GzipCodec{}.ID()}))
+	require.Equal([]string{hello, hello}, src.Written(), "hello is not sent again on reconnect")
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	codecs := []Codec{
+		FlateCodec{Level: 1}, FlateCodec{}, FlateCodec{Level: 9},
+		GzipCodec{Level: 1}, GzipCodec{},
+		SnappyCodec{}, ZstdCodec{Level: 1}, ZstdCodec{},
+	}
+	payloads := map[string][]byte{"json": jsonPayload(16 << 10), "random": randomPayload(16 << 10)}
+	for name, payload := range payloads {
+		for _, codec := range codecs {
+			b.Run(fmt.Sprintf("%s/%T/%d", name, codec, level(levelOf(codec))), func(b *testing.B) {
+				b.SetBytes(int64(len(payload)))
+				var compressedSize int
+				for i := 0; i < b.N; i++ {
+					compressed, err := codec.Compress(payload)
+					if err != nil {
+						b.Fatal(err)
+					}
+					compressedSize = len(compressed)
+				}
+				b.ReportMetric(float64(len(payload))/float64(compressedSize), "ratio")
+			})
+		}
+	}
+}
+
+func levelOf(codec Codec) int {
+	switch c := codec.(type) {
+	case FlateCodec:
+		return c.Level
+	case GzipCodec:
+		return c.Level
+	case ZstdCodec:
+		return c.Level
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+package source
+
+import "sync"
+
+// connReader is the reader of a NetworkSource that gets a fresh channel on every
+// Close. The channel handed out so far is closed to let its readers know the
+// connection is over, but only once Consume stops sending to it, as sending
+// to a closed channel panics.
+type connReader struct {
+	mx     sync.Mutex
+	reader chan []byte
+	// done is closed by close, ending the sends of Consume
+	done      chan struct{}
+	consuming bool
+}
+
+func newConnReader() *connReader {
+	return &connReader{reader: make(chan []byte), done: make(chan struct{})}
+}
+
+func (r *connReader) get() chan []byte {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.reader
+}
+
+// consume is called when Consume starts. It returns the channel to send to,
+// with a channel closed once the connection is closed, and release to be
+// called when Consume returns.
+func (r *connReader) consume() (reader chan []byte, done chan struct{}, release func()) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.consuming = true
+	reader, done = r.reader, r.done
+	return reader, done, func() {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.consuming = false
+		if r.reader != reader {
+			// closed while consuming, close has left the channel to us
+			close(reader)
+		}
+	}
+}
+
+// send sends msg to the reader Consume got, returning false if the connection
+// got closed before anybody read it
+func send(reader chan []byte, done chan struct{}, msg []byte) bool {
+	select {
+	case reader <- msg:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// close ends the sends and closes the channel handed out, or leaves it to
+// Consume if it is running, and makes a fresh one for the next connection
+func (r *connReader) close() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	close(r.done)
+	if !r.consuming {
+		close(r.reader)
+	}
+	r.reader = make(chan []byte)
+	r.done = make(chan struct{})
+}
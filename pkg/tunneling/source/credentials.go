@@ -0,0 +1,102 @@
+package source
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Credentials are added to the ws handshake request
+type Credentials struct {
+	Header http.Header
+	Query  url.Values
+}
+
+// BearerToken returns credentials with "Authorization: Bearer <token>" header
+func BearerToken(token string) Credentials {
+	return Credentials{Header: http.Header{"Authorization": []string{"Bearer " + token}}}
+}
+
+// CredentialsProvider is asked for credentials before every ws handshake.
+// refresh is true when the server rejected the previous credentials with 401,
+// so they must not be reused.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context, refresh bool) (Credentials, error)
+}
+
+// CredentialsFunc is an adapter to use ordinary functions as CredentialsProvider
+type CredentialsFunc func(ctx context.Context, refresh bool) (Credentials, error)
+
+func (f CredentialsFunc) Credentials(ctx context.Context, refresh bool) (Credentials, error) {
+	return f(ctx, refresh)
+}
+
+// StaticCredentials always provides the same credentials
+type StaticCredentials Credentials
+
+func (static StaticCredentials) Credentials(ctx context.Context, refresh bool) (Credentials, error) {
+	return Credentials(static), nil
+}
+
+// CachedCredentials fetches credentials only when the cached ones expire
+// (Leeway before the expiry time returned by fetch) or are rejected by the server
+type CachedCredentials struct {
+	fetch  func(ctx context.Context) (credentials Credentials, expiresAt time.Time, err error)
+	leeway time.Duration
+	clock  Clock
+
+	mx          sync.Mutex
+	credentials Credentials
+	expiresAt   time.Time
+}
+
+func NewCachedCredentials(
+	fetch func(ctx context.Context) (credentials Credentials, expiresAt time.Time, err error),
+	leeway time.Duration, clock Clock,
+) *CachedCredentials {
+	return &CachedCredentials{fetch: fetch, leeway: leeway, clock: clock}
+}
+
+func (cached *CachedCredentials) Credentials(ctx context.Context, refresh bool) (Credentials, error) {
+	cached.mx.Lock()
+	defer cached.mx.Unlock()
+	valid := cached.clock.Now().Add(cached.leeway).Before(cached.expiresAt)
+	if valid && !refresh {
+		return cached.credentials, nil
+	}
+	credentials, expiresAt, err := cached.fetch(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+	cached.credentials = credentials
+	cached.expiresAt = expiresAt
+	return credentials, nil
+}
+
+// apply returns url and header of the handshake request with credentials added
+func (credentials Credentials) apply(rawUrl string, header http.Header) (string, http.Header, error) {
+	if len(credentials.Header) > 0 {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		for name, values := range credentials.Header {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if len(credentials.Query) == 0 {
+		return rawUrl, header, nil
+	}
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", nil, err
+	}
+	query := parsed.Query()
+	for name, values := range credentials.Query {
+		query[name] = values
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), header, nil
+}
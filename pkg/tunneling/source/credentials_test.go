@@ -0,0 +1,81 @@
+package source
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/gorilla/websocket"
+	requirement "github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWSRefreshesCredentialsOn401(t *testing.T) {
+	require := requirement.New(t)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fresh" || r.URL.Query().Get("tenant") != "42" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			_ = conn.Close()
+		}
+	}))
+	defer server.Close()
+	refreshes := 0
+	provider := CredentialsFunc(func(ctx context.Context, refresh bool) (Credentials, error) {
+		token := "stale"
+		if refresh {
+			refreshes++
+			token = "fresh"
+		}
+		credentials := BearerToken(token)
+		credentials.Query = url.Values{"tenant": []string{"42"}}
+		return credentials, nil
+	})
+	ws := NewWSWithOptions(wsUrl(server), websocket.TextMessage, WSOptions{Credentials: provider}, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(ws.Connect(ctx))
+	require.Equal(1, refreshes)
+}
+
+func TestWSWithRejectedFreshCredentialsIsFatal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	options := WSOptions{Credentials: StaticCredentials(BearerToken("revoked"))}
+	ws := NewWSWithOptions(wsUrl(server), websocket.TextMessage, options, logutil.DummyLogger)
+
+	err := ws.Connect(context.Background())
+	requirement.True(t, IsFatal(err))
+}
+
+func TestCachedCredentialsExpire(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	fetches := 0
+	cached := NewCachedCredentials(func(ctx context.Context) (Credentials, time.Time, error) {
+		fetches++
+		return BearerToken("token"), clock.Now().Add(time.Hour), nil
+	}, time.Minute, clock)
+	ctx := context.Background()
+
+	_, err := cached.Credentials(ctx, false)
+	require.NoError(err)
+	_, _ = cached.Credentials(ctx, false)
+	require.Equal(1, fetches, "valid credentials were fetched again")
+
+	clock.Advance(59 * time.Minute) // within leeway of expiry
+	_, _ = cached.Credentials(ctx, false)
+	require.Equal(2, fetches, "credentials were not fetched before expiry")
+
+	_, _ = cached.Credentials(ctx, true)
+	require.Equal(3, fetches, "refresh did not fetch credentials")
+}
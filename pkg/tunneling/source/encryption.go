@@ -0,0 +1,444 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+// Message types of Encrypted (first byte of every message). The end starting
+// the handshake sends encryptedInit with its ephemeral key, the peer answers with
+// encryptedReply carrying its own ephemeral key and the one it answers.
+const (
+	encryptedInit  byte = 1
+	encryptedData  byte = 2
+	encryptedReply byte = 3
+)
+
+// dataHeaderSize is the size of the type, key id and counter in front of the
+// encrypted data, they are authenticated as additional data
+const dataHeaderSize = 1 + 4 + 8
+
+const keySize = curve25519.ScalarSize
+
+// ErrHandshake is returned when the encrypted session with the peer
+// cannot be established or is broken
+var ErrHandshake = errors.New("encryption handshake failed")
+
+// ErrUnauthenticatedPeer is returned by NewEncrypted when the options would not
+// authenticate the peer, so a relay in the middle could read the messages
+var ErrUnauthenticatedPeer = errors.New("encryption options do not authenticate the peer")
+
+// ErrReplay is returned when a message was already received or is out of order
+var ErrReplay = errors.New("replayed or reordered message")
+
+// GenerateEncryptionKey generates X25519 key pair to identify an Encrypted end
+func GenerateEncryptionKey() (private [keySize]byte, public [keySize]byte, err error) {
+	if _, err = io.ReadFull(rand.Reader, private[:]); err != nil {
+		return private, public, err
+	}
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return private, public, err
+	}
+	copy(public[:], pub)
+	return private, public, nil
+}
+
+// EncryptionOptions must authenticate the peer with PresharedKey or with
+// PrivateKey and PeerPublicKey together (or both ways)
+type EncryptionOptions struct {
+	// PrivateKey is the static key of this end (see GenerateEncryptionKey).
+	// Together with PeerPublicKey the session keys depend on both static keys,
+	// so a relay in the middle cannot impersonate either end.
+	PrivateKey *[keySize]byte
+	// PeerPublicKey pins the static key of the peer, handshake fails if it differs.
+	// It requires PrivateKey: anyone can claim a public key, only the session
+	// keys derived from the static keys prove the peer has the private one.
+	PeerPublicKey *[keySize]byte
+	// PresharedKey is mixed into the session keys, an alternative way to
+	// authenticate the peer when static keys are not used
+	PresharedKey []byte
+	// HandshakeTimeout is how long Write waits for the handshake, 10 seconds if 0
+	HandshakeTimeout time.Duration
+	// Clock is used to wait for the handshake, RealClock if nil
+	Clock Clock
+}
+
+type sessionKeys struct {
+	id      uint32 // tells the data of these keys from the data of former ones
+	send    cipher.AEAD
+	receive cipher.AEAD
+}
+
+// Encrypted is a Source that encrypts messages written to the wrapped source with
+// ChaCha20-Poly1305 and decrypts messages read from it, so that relays passing
+// the messages between the ends cannot read or modify them. Both ends must be
+// Encrypted: on Consume (and on every connection of a ConnectNotifier source)
+// an end sends a fresh ephemeral X25519 key, the peer answers with its own and
+// both derive new session keys. Every message carries a counter, messages with
+// a counter not greater than the last received one are rejected, as the wrapped
+// sources are expected to deliver messages in order. Messages are framed, so
+// that stream sources can be wrapped as well.
+type Encrypted struct {
+	Source
+	options EncryptionOptions
+	reader  chan []byte
+	frames  deframer
+	logger  *logrus.Logger
+
+	mx sync.Mutex
+	// ephemeral is the key of the handshake we started, if initiated
+	ephemeral   [keySize]byte
+	initiated   bool
+	keys        *sessionKeys
+	established chan struct{}
+	received    uint64
+	// writeMx keeps messages in the order of their counters and whole
+	// on stream sources
+	writeMx sync.Mutex
+	sent    uint64
+}
+
+// NewEncrypted fails with ErrUnauthenticatedPeer if options do not authenticate the peer
+func NewEncrypted(src Source, options EncryptionOptions, logger *logrus.Logger) (*Encrypted, error) {
+	if options.PeerPublicKey != nil && options.PrivateKey == nil {
+		return nil, fmt.Errorf("%w: PeerPublicKey requires PrivateKey", ErrUnauthenticatedPeer)
+	}
+	if options.PeerPublicKey == nil && len(options.PresharedKey) == 0 {
+		return nil, fmt.Errorf("%w: neither PresharedKey nor PeerPublicKey is set", ErrUnauthenticatedPeer)
+	}
+	if options.HandshakeTimeout == 0 {
+		options.HandshakeTimeout = 10 * time.Second
+	}
+	if options.Clock == nil {
+		options.Clock = RealClock
+	}
+	encrypted := &Encrypted{
+		Source:      src,
+		options:     options,
+		reader:      make(chan []byte),
+		logger:      logger,
+		established: make(chan struct{}),
+	}
+	if notifier, ok := src.(ConnectNotifier); ok {
+		notifier.OnConnect(encrypted.onConnect)
+	}
+	return encrypted, nil
+}
+
+func (encrypted *Encrypted) GetReader() chan []byte {
+	return encrypted.reader
+}
+
+// Labels passes through the labels of the wrapped source
+func (encrypted *Encrypted) Labels() Labels {
+	return LabelsOf(encrypted.Source)
+}
+
+// start begins a new handshake with a fresh ephemeral key, dropping the session
+// keys, and returns the framed init message
+func (encrypted *Encrypted) start() ([]byte, error) {
+	var ephemeral [keySize]byte
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	init, err := encrypted.withStatic(append([]byte{encryptedInit}, public...))
+	if err != nil {
+		return nil, err
+	}
+	encrypted.mx.Lock()
+	defer encrypted.mx.Unlock()
+	encrypted.ephemeral = ephemeral
+	encrypted.initiated = true
+	if encrypted.keys != nil {
+		encrypted.keys = nil
+		encrypted.established = make(chan struct{})
+	}
+	return frame(init), nil
+}
+
+// withStatic appends our static public key to a handshake message if we have one
+func (encrypted *Encrypted) withStatic(msg []byte) ([]byte, error) {
+	if encrypted.options.PrivateKey == nil {
+		return msg, nil
+	}
+	static, err := curve25519.X25519(encrypted.options.PrivateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return append(msg, static...), nil
+}
+
+// onConnect starts a new handshake on a new connection of the wrapped source
+func (encrypted *Encrypted) onConnect() []byte {
+	encrypted.frames.reset()
+	init, err := encrypted.start()
+	if err != nil {
+		encrypted.logger.Errorf("cannot start encryption handshake: %s", err)
+		return nil
+	}
+	return init
+}
+
+// Consume starts the handshake, unless the wrapped source is a ConnectNotifier
+// doing it on connect, and reads from the wrapped source, decrypting the
+// messages. It fails with ErrHandshake or ErrReplay when the peer is not the
+// expected one or the messages were tampered with.
+func (encrypted *Encrypted) Consume(ctx context.Context) error {
+	if _, ok := encrypted.Source.(ConnectNotifier); !ok {
+		init, err := encrypted.start()
+		if err != nil {
+			return err
+		}
+		if err := encrypted.Source.Write(init); err != nil {
+			return err
+		}
+	}
+	return consumeThrough(ctx, encrypted.Source, encrypted.reader, func(chunk []byte) ([][]byte, error) {
+		frames, err := encrypted.frames.feed(chunk)
+		if err != nil {
+			return nil, err
+		}
+		var plain [][]byte
+		for _, msg := range frames {
+			msgs, err := encrypted.handle(msg)
+			if err != nil {
+				return nil, err
+			}
+			plain = append(plain, msgs...)
+		}
+		return plain, nil
+	}, func(err error) {
+		encrypted.logger.Errorf("encrypted source is closing: %s", err)
+	})
+}
+
+// handle receives a message of the peer and sends the reply to a handshake.
+// It holds writeMx, so that nothing is written with the new session keys before
+// the reply the peer needs to derive them.
+func (encrypted *Encrypted) handle(msg []byte) ([][]byte, error) {
+	encrypted.writeMx.Lock()
+	defer encrypted.writeMx.Unlock()
+	plain, reply, err := encrypted.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	// written here, as receive holds mx and the wrapped source may call
+	// onConnect holding its own lock
+	if reply != nil {
+		if err := encrypted.Source.Write(frame(reply)); err != nil {
+			encrypted.logger.Errorf("cannot answer encryption handshake: %s", err)
+		}
+	}
+	return plain, nil
+}
+
+// receive handles a message of the peer, returning the decrypted data or
+// the reply to send to a handshake
+func (encrypted *Encrypted) receive(msg []byte) (plain [][]byte, reply []byte, err error) {
+	if len(msg) == 0 {
+		return nil, nil, fmt.Errorf("%w: empty message", ErrHandshake)
+	}
+	encrypted.mx.Lock()
+	defer encrypted.mx.Unlock()
+	switch msg[0] {
+	case encryptedInit:
+		reply, err := encrypted.answer(msg[1:])
+		return nil, reply, err
+	case encryptedReply:
+		return nil, nil, encrypted.complete(msg[1:])
+	case encryptedData:
+		plain, err := encrypted.decrypt(msg)
+		return plain, nil, err
+	}
+	return nil, nil, fmt.Errorf("%w: unknown message type %d", ErrHandshake, msg[0])
+}
+
+func (encrypted *Encrypted) decrypt(msg []byte) ([][]byte, error) {
+	if len(msg) < dataHeaderSize {
+		return nil, fmt.Errorf("%w: message too short", ErrHandshake)
+	}
+	keys := encrypted.keys
+	if keys == nil || binary.BigEndian.Uint32(msg[1:5]) != keys.id {
+		// sent before the last handshake, by the time it arrived the keys changed
+		encrypted.logger.Debugln("dropping encrypted message of former session keys")
+		return nil, nil
+	}
+	counter := binary.BigEndian.Uint64(msg[5:dataHeaderSize])
+	if counter <= encrypted.received {
+		return nil, ErrReplay
+	}
+	plain, err := keys.receive.Open(nil, nonce(counter), msg[dataHeaderSize:], msg[:dataHeaderSize])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshake, err)
+	}
+	encrypted.received = counter
+	return [][]byte{plain}, nil
+}
+
+// answer derives new session keys from the init of the peer and returns
+// the reply, must be called with mx held
+func (encrypted *Encrypted) answer(init []byte) ([]byte, error) {
+	peerEphemeral, peerStatic, err := encrypted.parseHandshake(init, 1)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted.initiated {
+		ourEphemeral, _ := curve25519.X25519(encrypted.ephemeral[:], curve25519.Basepoint)
+		if bytes.Compare(ourEphemeral, peerEphemeral) < 0 {
+			// both ends started the handshake, the peer answers ours
+			return nil, nil
+		}
+	}
+	var ephemeral [keySize]byte
+	if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := encrypted.derive(ephemeral, peerEphemeral, peerStatic, peerEphemeral, public, false); err != nil {
+		return nil, err
+	}
+	return encrypted.withStatic(append(append([]byte{encryptedReply}, public...), peerEphemeral...))
+}
+
+// complete derives new session keys from the reply of the peer to our init,
+// must be called with mx held
+func (encrypted *Encrypted) complete(reply []byte) error {
+	peerEphemeral, peerStatic, err := encrypted.parseHandshake(reply, 2)
+	if err != nil {
+		return err
+	}
+	ourEphemeral, _ := curve25519.X25519(encrypted.ephemeral[:], curve25519.Basepoint)
+	if !encrypted.initiated || !bytes.Equal(reply[keySize:2*keySize], ourEphemeral) {
+		// answers a handshake we no longer wait for
+		encrypted.logger.Debugln("dropping reply to a former encryption handshake")
+		return nil
+	}
+	return encrypted.derive(encrypted.ephemeral, peerEphemeral, peerStatic, ourEphemeral, peerEphemeral, true)
+}
+
+// parseHandshake returns the ephemeral and static keys of the peer from a handshake
+// message holding the given number of ephemeral keys, the peer's first, and
+// optionally its static key. It fails if the static key does not match the pinned one.
+func (encrypted *Encrypted) parseHandshake(msg []byte, keys int) (ephemeral []byte, static []byte, err error) {
+	if len(msg) != keys*keySize && len(msg) != (keys+1)*keySize {
+		return nil, nil, fmt.Errorf("%w: malformed handshake", ErrHandshake)
+	}
+	if len(msg) == (keys+1)*keySize {
+		static = msg[keys*keySize:]
+	}
+	pinned := encrypted.options.PeerPublicKey
+	if pinned != nil && (static == nil || subtle.ConstantTimeCompare(static, pinned[:]) != 1) {
+		return nil, nil, fmt.Errorf("%w: peer static key does not match the pinned one", ErrHandshake)
+	}
+	return msg[:keySize], static, nil
+}
+
+// derive sets the session keys derived from our ephemeral key and the keys of
+// the peer, must be called with mx held
+func (encrypted *Encrypted) derive(
+	ephemeral [keySize]byte, peerEphemeral, peerStatic, initiator, responder []byte, weInitiated bool,
+) error {
+	secret, err := curve25519.X25519(ephemeral[:], peerEphemeral)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrHandshake, err)
+	}
+	if encrypted.options.PrivateKey != nil && peerStatic != nil {
+		staticSecret, err := curve25519.X25519(encrypted.options.PrivateKey[:], peerStatic)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrHandshake, err)
+		}
+		secret = append(secret, staticSecret...)
+	}
+	info := append(append([]byte("tough_common e2e v2"), initiator...), responder...)
+	kdf := hkdf.New(sha256.New, secret, encrypted.options.PresharedKey, info)
+	material := make([]byte, 2*chacha20poly1305.KeySize+4)
+	if _, err := io.ReadFull(kdf, material); err != nil {
+		return err
+	}
+	fromInitiator, err := chacha20poly1305.New(material[:chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	fromResponder, err := chacha20poly1305.New(material[chacha20poly1305.KeySize : 2*chacha20poly1305.KeySize])
+	if err != nil {
+		return err
+	}
+	keys := &sessionKeys{id: binary.BigEndian.Uint32(material[2*chacha20poly1305.KeySize:])}
+	if weInitiated {
+		keys.send, keys.receive = fromInitiator, fromResponder
+	} else {
+		keys.send, keys.receive = fromResponder, fromInitiator
+	}
+	if encrypted.keys != nil {
+		encrypted.established = make(chan struct{})
+	}
+	encrypted.keys = keys
+	encrypted.initiated = false
+	encrypted.received = 0
+	close(encrypted.established)
+	encrypted.logger.Debugln("encrypted session established")
+	return nil
+}
+
+func nonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], counter)
+	return nonce
+}
+
+// Write encrypts the message and writes it to the wrapped source. It waits for
+// the handshake to complete for up to HandshakeTimeout.
+func (encrypted *Encrypted) Write(msg []byte) error {
+	timeout := encrypted.options.Clock.After(encrypted.options.HandshakeTimeout)
+	var keys *sessionKeys
+	for {
+		encrypted.mx.Lock()
+		keys = encrypted.keys
+		established := encrypted.established
+		encrypted.mx.Unlock()
+		if keys != nil {
+			break
+		}
+		select {
+		case <-established:
+		case <-timeout:
+			return fmt.Errorf("%w: timeout", ErrHandshake)
+		}
+	}
+
+	encrypted.writeMx.Lock()
+	defer encrypted.writeMx.Unlock()
+	encrypted.sent++
+	return encrypted.Source.Write(frame(seal(keys, encrypted.sent, msg)))
+}
+
+// seal encrypts msg with the keys and puts the data header in front of it
+func seal(keys *sessionKeys, counter uint64, msg []byte) []byte {
+	header := make([]byte, dataHeaderSize)
+	header[0] = encryptedData
+	binary.BigEndian.PutUint32(header[1:5], keys.id)
+	binary.BigEndian.PutUint64(header[5:], counter)
+	return keys.send.Seal(append([]byte{}, header...), nonce(counter), msg, header)
+}
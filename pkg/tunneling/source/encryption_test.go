@@ -0,0 +1,166 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newEncryptedPair(t *testing.T, left EncryptionOptions, right EncryptionOptions) (*Encrypted, *Encrypted) {
+	a, b := newPipe()
+	a.chunk, b.chunk = 5, 16 // as stream sources do
+	encryptedLeft, err := NewEncrypted(a, left, logutil.DummyLogger)
+	requirement.NoError(t, err)
+	encryptedRight, err := NewEncrypted(b, right, logutil.DummyLogger)
+	requirement.NoError(t, err)
+	return encryptedLeft, encryptedRight
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	require := requirement.New(t)
+	leftPrivate, leftPublic, err := GenerateEncryptionKey()
+	require.NoError(err)
+	rightPrivate, rightPublic, err := GenerateEncryptionKey()
+	require.NoError(err)
+	left, right := newEncryptedPair(t,
+		EncryptionOptions{PrivateKey: &leftPrivate, PeerPublicKey: &rightPublic},
+		EncryptionOptions{PrivateKey: &rightPrivate, PeerPublicKey: &leftPublic},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = left.Consume(ctx) }()
+	go func() { _ = right.Consume(ctx) }()
+
+	require.NoError(left.Write([]byte("to the right")))
+	require.Equal("to the right", string(<-right.GetReader()))
+	require.NoError(right.Write([]byte("to the left")))
+	require.Equal("to the left", string(<-left.GetReader()))
+}
+
+func TestEncryptedRejectsUnexpectedPeer(t *testing.T) {
+	leftPrivate, leftPublic, _ := GenerateEncryptionKey()
+	_, pinned, _ := GenerateEncryptionKey()
+	impostorPrivate, _, _ := GenerateEncryptionKey()
+	left, right := newEncryptedPair(t,
+		EncryptionOptions{PrivateKey: &leftPrivate, PeerPublicKey: &pinned},
+		EncryptionOptions{PrivateKey: &impostorPrivate, PeerPublicKey: &leftPublic},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = right.Consume(ctx) }()
+
+	err := left.Consume(ctx)
+	requirement.True(t, errors.Is(err, ErrHandshake), "unexpected error %v", err)
+}
+
+func TestNewEncryptedRejectsUnauthenticatedOptions(t *testing.T) {
+	private, public, err := GenerateEncryptionKey()
+	requirement.NoError(t, err)
+	a, _ := newPipe()
+	for name, options := range map[string]EncryptionOptions{
+		"nothing":                       {},
+		"private key only":              {PrivateKey: &private},
+		"peer key without private":      {PeerPublicKey: &public},
+		"peer key without private, psk": {PeerPublicKey: &public, PresharedKey: []byte("psk")},
+	} {
+		_, err := NewEncrypted(a, options, logutil.DummyLogger)
+		requirement.ErrorIs(t, err, ErrUnauthenticatedPeer, name)
+	}
+}
+
+func TestEncryptedRejectsReplayAndTampering(t *testing.T) {
+	require := requirement.New(t)
+	psk := []byte("preshared")
+	left, right := newEncryptedPair(t,
+		EncryptionOptions{PresharedKey: psk, HandshakeTimeout: time.Second},
+		EncryptionOptions{PresharedKey: psk},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = right.Consume(ctx) }()
+	leftCtx, leftCancel := context.WithCancel(ctx)
+	go func() { _ = left.Consume(leftCtx) }()
+	require.NoError(right.Write([]byte("first")))
+	require.Equal("first", string(<-left.GetReader()))
+	leftCancel()
+
+	// seal the first message again, as a relay replaying it would send it
+	replayed := seal(right.keys, 1, []byte("first"))
+	_, _, err := left.receive(replayed)
+	require.ErrorIs(err, ErrReplay)
+
+	tampered := append([]byte{}, replayed...)
+	tampered[dataHeaderSize-1] = 2
+	_, _, err = left.receive(tampered)
+	require.ErrorIs(err, ErrHandshake)
+}
+
+func TestEncryptedHandshakesAgain(t *testing.T) {
+	require := requirement.New(t)
+	psk := []byte("preshared")
+	left, right := newEncryptedPair(t, EncryptionOptions{PresharedKey: psk}, EncryptionOptions{PresharedKey: psk})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = left.Consume(ctx) }()
+	go func() { _ = right.Consume(ctx) }()
+	require.NoError(left.Write([]byte("before")))
+	require.Equal("before", string(<-right.GetReader()))
+	left.mx.Lock()
+	former := left.keys.id
+	left.mx.Unlock()
+
+	// as a Reconnecting source does on connect
+	init, err := left.start()
+	require.NoError(err)
+	require.NoError(left.Source.Write(init))
+	require.NoError(left.Write([]byte("after")))
+	require.Equal("after", string(<-right.GetReader()))
+	require.NoError(right.Write([]byte("back")))
+	require.Equal("back", string(<-left.GetReader()))
+	left.mx.Lock()
+	defer left.mx.Unlock()
+	require.NotEqual(former, left.keys.id, "session keys did not change")
+}
+
+func TestEncryptedStartsHandshakeOnEveryConnection(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(0, NewReadError("mock", errors.New("connection reset")))
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	encrypted, err := NewEncrypted(NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger),
+		EncryptionOptions{PresharedKey: []byte("preshared")}, logutil.DummyLogger)
+	require.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = encrypted.Consume(ctx) }()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for len(src.Written()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	written := src.Written()
+	require.Len(written, 2)
+	for _, init := range written {
+		require.Equal(frameHeaderSize+1+keySize, len(init))
+		require.Equal(encryptedInit, init[frameHeaderSize])
+	}
+	require.NotEqual(written[0], written[1], "ephemeral key is reused")
+}
+
+func TestEncryptedWriteWaitsForHandshakeOnClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	a, _ := newPipe()
+	encrypted, err := NewEncrypted(a, EncryptionOptions{PresharedKey: []byte("preshared"), Clock: clock}, logutil.DummyLogger)
+	requirement.NoError(t, err)
+	done := make(chan error)
+
+	go func() { done <- encrypted.Write([]byte("too early")) }()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(10 * time.Second)
+	requirement.ErrorIs(t, <-done, ErrHandshake)
+}
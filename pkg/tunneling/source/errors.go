@@ -1,10 +1,20 @@
 package source
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"net"
+	"net/http"
 )
 
+// ErrNotConnected is returned by Write of a source that lost its connection
+// and is not able to keep the message until it reconnects
+var ErrNotConnected = errors.New("source is not connected")
+
+// ErrMessageTooBig is returned when a message exceeds the size limit of a source
+var ErrMessageTooBig = errors.New("message too big")
+
 // FatalConnectError is used when connection cannot be established and there is no chance
 // that it will change (in other words the error is not temporary, so there is no need
 // to retry connecting)
@@ -20,7 +30,181 @@ func (fatalConnErr FatalConnectError) Error() string {
 	return fmt.Sprintf("fatal connect error: %s", fatalConnErr.Err)
 }
 
+func (fatalConnErr FatalConnectError) Unwrap() error {
+	return fatalConnErr.Err
+}
+
+// ConnectError is returned when a network source could not connect to its url.
+// Unless wrapped in FatalConnectError, the attempt may be repeated.
+type ConnectError struct {
+	Url string
+	Err error
+}
+
+func NewConnectError(url string, err error) *ConnectError {
+	return &ConnectError{Url: url, Err: err}
+}
+
+func (connErr ConnectError) Error() string {
+	return fmt.Sprintf("cannot connect to %s: %s", connErr.Url, connErr.Err)
+}
+
+func (connErr ConnectError) Unwrap() error {
+	return connErr.Err
+}
+
+// ReadError is returned by Consume when reading from the underlying connection fails
+type ReadError struct {
+	Url string
+	Err error
+}
+
+func NewReadError(url string, err error) *ReadError {
+	return &ReadError{Url: url, Err: err}
+}
+
+func (readErr ReadError) Error() string {
+	return fmt.Sprintf("cannot read from %s: %s", readErr.Url, readErr.Err)
+}
+
+func (readErr ReadError) Unwrap() error {
+	return readErr.Err
+}
+
+// WriteError is returned by Write when the message could not be sent
+type WriteError struct {
+	Url string
+	Err error
+}
+
+func NewWriteError(url string, err error) *WriteError {
+	return &WriteError{Url: url, Err: err}
+}
+
+func (writeErr WriteError) Error() string {
+	return fmt.Sprintf("cannot write to %s: %s", writeErr.Url, writeErr.Err)
+}
+
+func (writeErr WriteError) Unwrap() error {
+	return writeErr.Err
+}
+
+// PeerClosedError is returned when the remote side closed the connection
+// (EOF on tcp, close frame other than normal closure on ws)
+type PeerClosedError struct {
+	Url string
+	Err error
+}
+
+func NewPeerClosedError(url string, err error) *PeerClosedError {
+	return &PeerClosedError{Url: url, Err: err}
+}
+
+func (peerErr PeerClosedError) Error() string {
+	return fmt.Sprintf("connection closed by peer %s: %s", peerErr.Url, peerErr.Err)
+}
+
+func (peerErr PeerClosedError) Unwrap() error {
+	return peerErr.Err
+}
+
+// TimeoutError is returned when an operation on a source did not complete in time.
+// It implements net.Error, so callers checking for Timeout() keep working.
+type TimeoutError struct {
+	Url string
+	Err error
+}
+
+func NewTimeoutError(url string, err error) *TimeoutError {
+	return &TimeoutError{Url: url, Err: err}
+}
+
+func (timeoutErr TimeoutError) Error() string {
+	return fmt.Sprintf("timeout on %s: %s", timeoutErr.Url, timeoutErr.Err)
+}
+
+func (timeoutErr TimeoutError) Unwrap() error {
+	return timeoutErr.Err
+}
+
+func (timeoutErr TimeoutError) Timeout() bool {
+	return true
+}
+
+func (timeoutErr TimeoutError) Temporary() bool {
+	return true
+}
+
+// HandshakeError is returned when ws server answered the handshake with
+// a non-101 status
+type HandshakeError struct {
+	StatusCode int
+	Header     http.Header
+}
+
+func NewHandshakeError(statusCode int, header http.Header) *HandshakeError {
+	return &HandshakeError{StatusCode: statusCode, Header: header}
+}
+
+func (handshakeErr HandshakeError) Error() string {
+	return fmt.Sprintf("response status is %d", handshakeErr.StatusCode)
+}
+
+// StatusCode returns the handshake response status wrapped in err, 0 if there is none
+func StatusCode(err error) int {
+	var handshakeErr *HandshakeError
+	if errors.As(err, &handshakeErr) {
+		return handshakeErr.StatusCode
+	}
+	return 0
+}
+
+// IsClosedConnError reports whether err is caused by using a connection
+// that was already closed on our side
 func IsClosedConnError(err error) bool {
-	str := err.Error()
-	return strings.Contains(str, "use of closed network connection")
+	return errors.Is(err, net.ErrClosed)
+}
+
+// IsTimeoutError reports whether err (or any error it wraps) is a timeout
+func IsTimeoutError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// IsFatal reports whether err means that there is no point in connecting again
+func IsFatal(err error) bool {
+	var fatalErr *FatalConnectError
+	return errors.As(err, &fatalErr)
+}
+
+// IsRetryable reports whether the operation that returned err may succeed
+// if repeated: connect, read and write failures, peer closures and timeouts are
+// retryable unless they are fatal or caused by closing the connection ourselves.
+func IsRetryable(err error) bool {
+	if err == nil || IsFatal(err) || IsClosedConnError(err) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var connErr *ConnectError
+	var readErr *ReadError
+	var writeErr *WriteError
+	var peerErr *PeerClosedError
+	return errors.As(err, &connErr) ||
+		errors.As(err, &readErr) ||
+		errors.As(err, &writeErr) ||
+		errors.As(err, &peerErr) ||
+		IsTimeoutError(err)
+}
+
+// wrapTimeout turns timeouts into TimeoutError, leaving other errors untouched
+func wrapTimeout(url string, err error) error {
+	if IsTimeoutError(err) {
+		return NewTimeoutError(url, err)
+	}
+	return err
 }
@@ -0,0 +1,59 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	requirement "github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestIsFatalFindsWrappedFatalError(t *testing.T) {
+	require := requirement.New(t)
+	fatal := NewFatalConnectError(NewConnectError("localhost:1", errors.New("refused")))
+
+	require.True(IsFatal(fatal))
+	require.True(IsFatal(fmt.Errorf("retrier: %w", fatal)))
+	require.False(IsFatal(NewConnectError("localhost:1", errors.New("refused"))))
+	require.False(IsRetryable(fatal), "fatal error must not be retryable")
+}
+
+func TestIsRetryable(t *testing.T) {
+	require := requirement.New(t)
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{errors.New("unknown"), false},
+		{NewConnectError("u", errors.New("refused")), true},
+		{NewReadError("u", errors.New("reset")), true},
+		{NewWriteError("u", errors.New("broken pipe")), true},
+		{NewPeerClosedError("u", io.EOF), true},
+		{NewTimeoutError("u", context.DeadlineExceeded), true},
+		{NewReadError("u", net.ErrClosed), false},
+		{context.Canceled, false},
+	}
+	for _, c := range cases {
+		require.Equal(c.retryable, IsRetryable(c.err), "IsRetryable(%v)", c.err)
+	}
+}
+
+func TestIsClosedConnErrorUsesErrorChain(t *testing.T) {
+	require := requirement.New(t)
+	opErr := &net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}
+
+	require.True(IsClosedConnError(opErr))
+	require.True(IsClosedConnError(NewReadError("u", opErr)))
+	require.False(IsClosedConnError(io.EOF))
+}
+
+func TestTimeoutErrorIsNetError(t *testing.T) {
+	var netErr net.Error
+	err := NewConnectError("u", NewTimeoutError("u", context.DeadlineExceeded))
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("TimeoutError must be found as a net.Error with Timeout() == true")
+	}
+}
@@ -0,0 +1,278 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FailoverStrategy int
+
+const (
+	// FailoverPriority tries endpoints in the order they were given
+	FailoverPriority FailoverStrategy = iota
+	// FailoverRoundRobin starts with the endpoint next to the last used one
+	FailoverRoundRobin
+	// FailoverRandom tries endpoints in random order, picking ones with bigger
+	// Weight more often
+	FailoverRandom
+)
+
+type Endpoint struct {
+	Url string
+	// Weight is used by FailoverRandom, endpoints with Weight < 1 are treated as 1
+	Weight int
+}
+
+// Failover is a NetworkSource connecting to one of several endpoints.
+// On Connect it goes through the endpoints according to its strategy, trying
+// the healthy ones (the ones that did not fail last time) first, and uses
+// the first one that connects. GetUrl returns the url of that active endpoint.
+type Failover struct {
+	endpoints []Endpoint
+	strategy  FailoverStrategy
+	newSource func(url string) NetworkSource
+	rand      *rand.Rand
+	logger    *logrus.Logger
+
+	mx      sync.Mutex
+	sources []NetworkSource
+	healthy []bool
+	active  int
+}
+
+// NewFailover creates a failover source. newSource creates the source for an
+// endpoint url, e.g. func(url string) NetworkSource { return NewTCP(url, logger) }
+func NewFailover(
+	endpoints []Endpoint, strategy FailoverStrategy,
+	newSource func(url string) NetworkSource, logger *logrus.Logger,
+) *Failover {
+	healthy := make([]bool, len(endpoints))
+	for i := range healthy {
+		healthy[i] = true
+	}
+	return &Failover{
+		endpoints: endpoints,
+		strategy:  strategy,
+		newSource: newSource,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger:    logger,
+		sources:   make([]NetworkSource, len(endpoints)),
+		healthy:   healthy,
+		active:    -1,
+	}
+}
+
+func (f *Failover) source(i int) NetworkSource {
+	if f.sources[i] == nil {
+		f.sources[i] = f.newSource(f.endpoints[i].Url)
+	}
+	return f.sources[i]
+}
+
+func (f *Failover) activeSource() NetworkSource {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.active < 0 {
+		return nil
+	}
+	return f.sources[f.active]
+}
+
+// GetUrl returns the url of the endpoint in use, or of the first endpoint
+// if nothing was connected yet
+func (f *Failover) GetUrl() string {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.active >= 0 {
+		return f.endpoints[f.active].Url
+	}
+	if len(f.endpoints) == 0 {
+		return ""
+	}
+	return f.endpoints[0].Url
+}
+
+// Healthy reports which endpoints did not fail last time they were used
+func (f *Failover) Healthy() map[string]bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	result := make(map[string]bool, len(f.endpoints))
+	for i, endpoint := range f.endpoints {
+		result[endpoint.Url] = f.healthy[i]
+	}
+	return result
+}
+
+// order returns endpoint indexes in the order they should be tried
+func (f *Failover) order() []int {
+	n := len(f.endpoints)
+	order := make([]int, 0, n)
+	switch f.strategy {
+	case FailoverRoundRobin:
+		for i := 1; i <= n; i++ {
+			order = append(order, (f.active+i+n)%n)
+		}
+	case FailoverRandom:
+		left := make([]int, n)
+		for i := range left {
+			left[i] = i
+		}
+		for len(left) > 0 {
+			total := 0
+			for _, i := range left {
+				total += weight(f.endpoints[i])
+			}
+			pick := f.rand.Intn(total)
+			for j, i := range left {
+				pick -= weight(f.endpoints[i])
+				if pick < 0 {
+					order = append(order, i)
+					left = append(left[:j], left[j+1:]...)
+					break
+				}
+			}
+		}
+	default:
+		for i := 0; i < n; i++ {
+			order = append(order, i)
+		}
+	}
+	// healthy endpoints go first, keeping the order within both groups
+	sorted := make([]int, 0, n)
+	for _, i := range order {
+		if f.healthy[i] {
+			sorted = append(sorted, i)
+		}
+	}
+	for _, i := range order {
+		if !f.healthy[i] {
+			sorted = append(sorted, i)
+		}
+	}
+	return sorted
+}
+
+func weight(endpoint Endpoint) int {
+	if endpoint.Weight < 1 {
+		return 1
+	}
+	return endpoint.Weight
+}
+
+// FailoverError is the error of Failover.Connect when no endpoint connected.
+// errors.Is and errors.As look into the errors of every endpoint, so that e.g.
+// StatusCode and RetryAfter see the response of an endpoint. The endpoint errors
+// are kept without their FatalConnectError, Failover decides if it failed fatally.
+type FailoverError struct {
+	Errs []error
+}
+
+func (failoverErr FailoverError) Error() string {
+	texts := make([]string, 0, len(failoverErr.Errs))
+	for _, err := range failoverErr.Errs {
+		texts = append(texts, err.Error())
+	}
+	return strings.Join(texts, "; ")
+}
+
+func (failoverErr FailoverError) Is(target error) bool {
+	for _, err := range failoverErr.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (failoverErr FailoverError) As(target interface{}) bool {
+	for _, err := range failoverErr.Errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connect tries the endpoints one by one until one of them connects.
+// The error is fatal only if every endpoint failed fatally.
+func (f *Failover) Connect(ctx context.Context) error {
+	f.mx.Lock()
+	order := f.order()
+	f.mx.Unlock()
+	if len(order) == 0 {
+		return NewFatalConnectError(errors.New("failover has no endpoints"))
+	}
+	errs := make([]error, 0, len(order))
+	allFatal := true
+	for _, i := range order {
+		f.mx.Lock()
+		src := f.source(i)
+		f.mx.Unlock()
+		url := f.endpoints[i].Url
+		err := src.Connect(ctx)
+		if err == nil {
+			f.logger.Infof("failover connected to %s", url)
+			f.mx.Lock()
+			f.active = i
+			f.healthy[i] = true
+			f.mx.Unlock()
+			return nil
+		}
+		f.logger.Errorf("failover could not connect to %s: %s", url, err)
+		f.mx.Lock()
+		f.healthy[i] = false
+		f.mx.Unlock()
+		var fatalErr *FatalConnectError
+		if errors.As(err, &fatalErr) {
+			err = fatalErr.Err
+		} else {
+			allFatal = false
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	err := NewConnectError(f.GetUrl(), &FailoverError{Errs: errs})
+	if allFatal {
+		return NewFatalConnectError(err)
+	}
+	return err
+}
+
+func (f *Failover) GetReader() chan []byte {
+	src := f.activeSource()
+	if src == nil {
+		return nil
+	}
+	return src.GetReader()
+}
+
+// Consume reads from the active endpoint. If the connection breaks with an error,
+// the endpoint is marked unhealthy so the next Connect prefers the other ones.
+func (f *Failover) Consume(ctx context.Context) error {
+	src := f.activeSource()
+	if src == nil {
+		return ErrNotConnected
+	}
+	err := src.Consume(ctx)
+	if err != nil && ctx.Err() == nil {
+		f.mx.Lock()
+		f.healthy[f.active] = false
+		f.mx.Unlock()
+	}
+	return err
+}
+
+func (f *Failover) Write(msg []byte) error {
+	src := f.activeSource()
+	if src == nil {
+		return ErrNotConnected
+	}
+	return src.Write(msg)
+}
@@ -0,0 +1,113 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newFailoverWithMocks(strategy FailoverStrategy, failConnects map[string]int) (*Failover, map[string]*NetworkSourceMock) {
+	mocks := make(map[string]*NetworkSourceMock)
+	endpoints := make([]Endpoint, 0)
+	for _, url := range []string{"a", "b", "c"} {
+		mocks[url] = NewNetworkSourceMock(failConnects[url])
+		endpoints = append(endpoints, Endpoint{Url: url, Weight: 1})
+	}
+	failover := NewFailover(endpoints, strategy, func(url string) NetworkSource {
+		return mocks[url]
+	}, logutil.DummyLogger)
+	return failover, mocks
+}
+
+func TestFailoverImplementsInterfaces(t *testing.T) {
+	failover, _ := newFailoverWithMocks(FailoverPriority, nil)
+	var _ NetworkSource = failover
+}
+
+func TestFailoverPriorityPrefersHealthyEndpoints(t *testing.T) {
+	require := requirement.New(t)
+	failover, mocks := newFailoverWithMocks(FailoverPriority, map[string]int{"a": 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(failover.Connect(ctx))
+	require.Equal("b", failover.GetUrl())
+	require.False(failover.Healthy()["a"])
+
+	require.NoError(failover.Connect(ctx))
+	require.Equal("b", failover.GetUrl(), "failover went back to unhealthy endpoint first")
+	require.Equal(1, mocks["a"].Connects())
+}
+
+func TestFailoverRoundRobinRotates(t *testing.T) {
+	require := requirement.New(t)
+	failover, _ := newFailoverWithMocks(FailoverRoundRobin, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, expected := range []string{"a", "b", "c", "a"} {
+		require.NoError(failover.Connect(ctx))
+		require.Equal(expected, failover.GetUrl())
+	}
+}
+
+func TestFailoverRandomTriesEveryEndpoint(t *testing.T) {
+	require := requirement.New(t)
+	failover, mocks := newFailoverWithMocks(FailoverRandom, map[string]int{"a": 1, "b": 1, "c": 1})
+
+	err := failover.Connect(context.Background())
+	require.Error(err)
+	require.False(IsFatal(err), "retryable endpoint errors must not become fatal")
+	for url, mock := range mocks {
+		require.Equal(1, mock.Connects(), "endpoint %s was not tried", url)
+	}
+}
+
+func TestFailoverErrorKeepsEndpointErrors(t *testing.T) {
+	require := requirement.New(t)
+	failover, mocks := newFailoverWithMocks(FailoverPriority, map[string]int{"a": 1, "b": 1, "c": 1})
+	header := http.Header{"Retry-After": []string{"30"}}
+	mocks["a"].connectErr = NewFatalConnectError(NewConnectError("a", errors.New("unknown host key")))
+	mocks["b"].connectErr = NewConnectError("b", NewHandshakeError(http.StatusServiceUnavailable, header))
+	mocks["c"].connectErr = NewFatalConnectError(NewConnectError("c", errors.New("unknown host key")))
+
+	err := failover.Connect(context.Background())
+	require.False(IsFatal(err), "fatal when only some endpoints failed fatally")
+	require.Equal(http.StatusServiceUnavailable, StatusCode(err))
+	require.Equal(30*time.Second, RetryAfter(err, time.Now()))
+	require.Equal(FailureRateLimited, DefaultClassifier.Classify(err, StatusCode(err)).Class)
+}
+
+func TestReconnectingFailoverRetriesWhenEveryEndpointRefuses(t *testing.T) {
+	require := requirement.New(t)
+	var endpoints []Endpoint
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		endpoints = append(endpoints, Endpoint{Url: listener.Addr().String()})
+		require.NoError(listener.Close()) // nobody listens anymore, dials are refused
+	}
+	failover := NewFailover(endpoints, FailoverPriority, func(url string) NetworkSource {
+		return NewTCP(url, logutil.DummyLogger)
+	}, logutil.DummyLogger)
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	tries := 2
+	policy := RetryPolicy{Tries: &tries, Backoff: ConstantBackoff{Delay: time.Minute}}
+	retrier := NewRetrierWithClock(failover, policy, clock, logutil.DummyLogger)
+	reconnecting := NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger)
+	done := make(chan error)
+	go func() {
+		done <- reconnecting.Consume(context.Background())
+	}()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+	err := <-done
+	require.Error(err)
+	require.False(IsFatal(err), "refused dials of every endpoint gave up reconnecting")
+}
@@ -0,0 +1,64 @@
+package source
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxFrameSize limits frames read by deframer, a bigger length means the
+// stream is broken rather than a message that big is coming
+const maxFrameSize = 64 << 20
+
+const frameHeaderSize = 4
+
+// ErrBrokenFrame is returned when the frames read from a source cannot be told apart
+var ErrBrokenFrame = errors.New("broken framing")
+
+// frame prefixes msg with its length. Stream sources (TCP, SSHForward,
+// SSHChannel) split and merge what is written to them, so wrappers that need
+// the messages whole frame them and put them together again with deframer.
+func frame(msg []byte) []byte {
+	framed := make([]byte, frameHeaderSize, frameHeaderSize+len(msg))
+	binary.BigEndian.PutUint32(framed, uint32(len(msg)))
+	return append(framed, msg...)
+}
+
+// deframer collects frames from the chunks read from a source
+type deframer struct {
+	mx  sync.Mutex
+	buf []byte
+}
+
+// feed returns the frames completed by chunk
+func (d *deframer) feed(chunk []byte) ([][]byte, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	d.buf = append(d.buf, chunk...)
+	var frames [][]byte
+	for len(d.buf) >= frameHeaderSize {
+		size := binary.BigEndian.Uint32(d.buf)
+		if size > maxFrameSize {
+			d.buf = nil
+			return frames, fmt.Errorf("%w: frame of %d bytes", ErrBrokenFrame, size)
+		}
+		end := frameHeaderSize + int(size)
+		if len(d.buf) < end {
+			break
+		}
+		frames = append(frames, append([]byte{}, d.buf[frameHeaderSize:end]...))
+		d.buf = d.buf[end:]
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil // let the consumed chunks be collected
+	}
+	return frames, nil
+}
+
+// reset drops a partial frame, e.g. of a connection that broke
+func (d *deframer) reset() {
+	d.mx.Lock()
+	d.buf = nil
+	d.mx.Unlock()
+}
@@ -0,0 +1,25 @@
+package source
+
+import (
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDeframerSplitsAndJoinsChunks(t *testing.T) {
+	require := requirement.New(t)
+	var frames deframer
+	stream := append(append(frame([]byte("first")), frame(nil)...), frame([]byte("second"))...)
+
+	got, err := frames.feed(stream[:3])
+	require.NoError(err)
+	require.Empty(got)
+	got, err = frames.feed(stream[3:15])
+	require.NoError(err)
+	require.Equal([][]byte{[]byte("first"), {}}, got)
+	got, err = frames.feed(stream[15:])
+	require.NoError(err)
+	require.Equal([][]byte{[]byte("second")}, got)
+
+	_, err = frames.feed([]byte{0xff, 0xff, 0xff, 0xff})
+	require.ErrorIs(err, ErrBrokenFrame)
+}
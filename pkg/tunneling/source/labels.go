@@ -0,0 +1,44 @@
+package source
+
+// Labels describe the identity of a source, e.g. {"role": "agent", "principal": "agent-1"}
+type Labels map[string]string
+
+// Matches reports whether labels satisfy selector: every key of the selector
+// must have the same value in labels, value "*" only requires the key to exist.
+// Empty selector matches anything.
+func (labels Labels) Matches(selector Labels) bool {
+	for key, value := range selector {
+		actual, ok := labels[key]
+		if !ok || (value != "*" && value != actual) {
+			return false
+		}
+	}
+	return true
+}
+
+// Labeled is implemented by sources that carry identity labels
+type Labeled interface {
+	Labels() Labels
+}
+
+// LabelsOf returns labels of the source, nil if it has none
+func LabelsOf(src Source) Labels {
+	if labeled, ok := src.(Labeled); ok {
+		return labeled.Labels()
+	}
+	return nil
+}
+
+// LabeledSource attaches labels to a source that does not have its own
+type LabeledSource struct {
+	Source
+	labels Labels
+}
+
+func WithLabels(src Source, labels Labels) *LabeledSource {
+	return &LabeledSource{Source: src, labels: labels}
+}
+
+func (labeled *LabeledSource) Labels() Labels {
+	return labeled.labels
+}
@@ -0,0 +1,211 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+// ConnectNotifier is implemented by sources that connect again inside Consume
+// (Reconnecting). Wrappers keeping a session with the peer, as Compressed and
+// Encrypted do, start it over on every connection.
+type ConnectNotifier interface {
+	// OnConnect registers hello to be called every time the source gets
+	// connected, the message it returns (if not nil) is sent before anything else
+	OnConnect(hello func() []byte)
+}
+
+// Reconnecting is a Source that keeps a NetworkSource connected for as long as
+// it is consumed. Unlike Retrier.Start it reconnects inside Consume, so it can be
+// added to a Transmitter directly, and its reader channel stays the same across
+// reconnects.
+type Reconnecting struct {
+	retrier    *Retrier
+	reader     chan []byte
+	mx         sync.Mutex
+	connected  bool
+	buffer     [][]byte
+	bufferSize int
+	hellos     []func() []byte
+	logger     *logrus.Logger
+}
+
+// NewReconnecting creates a reconnecting source. Messages written while the source
+// is disconnected are kept (at most bufferSize of them) and sent after reconnect.
+// With bufferSize 0 such writes fail with ErrNotConnected.
+func NewReconnecting(source NetworkSource, policy RetryPolicy, bufferSize int, logger *logrus.Logger) *Reconnecting {
+	return NewReconnectingWithRetrier(NewRetrier(source, policy, logger), bufferSize, logger)
+}
+
+// NewReconnectingWithRetrier creates a reconnecting source connecting with a copy
+// of retrier that also retries failed dials (see dialRetryable). retrier itself
+// is not changed, the circuit breaker and retry budget of its policy are shared.
+func NewReconnectingWithRetrier(retrier *Retrier, bufferSize int, logger *logrus.Logger) *Reconnecting {
+	policy := retrier.policy
+	policy.Classifier = dialRetryable(policy.classifier(retrier.clock))
+	return &Reconnecting{
+		retrier:    NewRetrierWithClock(retrier.NetworkSource, policy, retrier.clock, retrier.logger),
+		reader:     make(chan []byte),
+		buffer:     make([][]byte, 0),
+		bufferSize: bufferSize,
+		logger:     logger,
+	}
+}
+
+func (r *Reconnecting) GetUrl() string {
+	return r.retrier.GetUrl()
+}
+
+func (r *Reconnecting) GetReader() chan []byte {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.reader
+}
+
+// Retrier returns the retrier used to (re)connect, e.g. to look at its NextAttempt
+func (r *Reconnecting) Retrier() *Retrier {
+	return r.retrier
+}
+
+// OnConnect registers hello to be called on every connection, see ConnectNotifier
+func (r *Reconnecting) OnConnect(hello func() []byte) {
+	r.mx.Lock()
+	r.hellos = append(r.hellos, hello)
+	r.mx.Unlock()
+}
+
+// Consume connects the source and reads from it until ctx is done, connecting
+// again every time the connection breaks. It returns an error only if the source
+// cannot be connected according to the retry policy.
+func (r *Reconnecting) Consume(ctx context.Context) error {
+	defer r.logger.Debugln("reconnecting.Consume() ends")
+	reader := r.GetReader()
+	defer r.closeReader()
+	url := r.retrier.GetUrl()
+	getTimeout := r.retrier.getTimeoutFunc()
+	for {
+		connCtx, cancel := context.WithCancel(ctx)
+		err := r.retrier.Connect(connCtx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if ctx.Err() != nil {
+			cancel()
+			return nil
+		}
+		connectedAt := r.retrier.clock.Now()
+		forwarded := r.forward(ctx, r.retrier.GetReader(), reader)
+		r.setConnected(true)
+
+		err = r.retrier.NetworkSource.Consume(connCtx)
+		r.setConnected(false)
+		cancel()
+		// the source closes its reader when it is closed, wait for that
+		// so that the next connection does not overlap with this one
+		<-forwarded
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && IsFatal(err) {
+			return err
+		}
+		r.logger.Infof("connection to %s is lost (%v), reconnecting", url, err)
+		wasStable := r.retrier.policy.ResetAfter > 0 &&
+			r.retrier.clock.Now().Sub(connectedAt) >= r.retrier.policy.ResetAfter
+		if wasStable {
+			getTimeout = r.retrier.getTimeoutFunc()
+		}
+		if !r.retrier.wait(ctx, getTimeout()) {
+			return nil
+		}
+	}
+}
+
+// forward copies messages from the reader of the current connection to our reader
+// until the former is closed
+func (r *Reconnecting) forward(ctx context.Context, from chan []byte, to chan []byte) (done chan struct{}) {
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range from {
+			select {
+			case to <- msg:
+			case <-ctx.Done():
+				// nobody reads anymore, drop the message to let the connection close
+			}
+		}
+	}()
+	return done
+}
+
+// closeReader closes the reader once nothing forwards to it anymore, and makes
+// a fresh one for the next Consume
+func (r *Reconnecting) closeReader() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	closedReader := r.reader
+	r.reader = make(chan []byte)
+	close(closedReader)
+}
+
+// setConnected marks the source as (dis)connected, sending the hellos and
+// the buffered messages when it gets connected
+func (r *Reconnecting) setConnected(connected bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.connected = connected
+	if !connected {
+		return
+	}
+	for _, hello := range r.hellos {
+		msg := hello()
+		if msg == nil {
+			continue
+		}
+		if err := r.retrier.NetworkSource.Write(msg); err != nil {
+			r.logger.Errorf("could not send hello to %s: %s", r.retrier.GetUrl(), err)
+			r.connected = false
+			return
+		}
+	}
+	for i, msg := range r.buffer {
+		err := r.retrier.NetworkSource.Write(msg)
+		if err != nil {
+			r.logger.Errorf("could not send buffered message to %s: %s", r.retrier.GetUrl(), err)
+			// keep buffering not to reorder messages, the connection is about to break anyway
+			r.buffer = r.buffer[i:]
+			r.connected = false
+			return
+		}
+	}
+	r.buffer = r.buffer[:0]
+}
+
+func (r *Reconnecting) Write(msg []byte) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.connected {
+		return r.retrier.NetworkSource.Write(msg)
+	}
+	if len(r.buffer) >= r.bufferSize {
+		return ErrNotConnected
+	}
+	r.buffer = append(r.buffer, msg)
+	return nil
+}
+
+// dialRetryable makes failed dials retryable, though sources report them as fatal
+// when a next attempt is not expected to do better (e.g. TCP without a resolver):
+// a reconnecting source waits for the peer to come back
+func dialRetryable(classifier Classifier) Classifier {
+	return ClassifierFunc(func(err error, statusCode int) Classification {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return Classification{Class: FailureRetryable}
+		}
+		return classifier.Classify(err, statusCode)
+	})
+}
@@ -0,0 +1,101 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReconnectingImplementsInterfaces(t *testing.T) {
+	var _ Source = NewReconnecting(NewNetworkSourceMock(0), DefaultRetryPolicy, 0, logutil.DummyLogger)
+}
+
+func TestReconnectingKeepsReaderAcrossReconnects(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(0, NewReadError("mock", errors.New("connection reset")))
+	src.messages = []string{"hello"}
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	reconnecting := NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger)
+	reader := reconnecting.GetReader()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- reconnecting.Consume(ctx)
+	}()
+	require.Equal("hello", string(<-reader))
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+	require.Equal("hello", string(<-reader), "no message after reconnect")
+	require.Equal(2, src.Connects())
+
+	cancel()
+	require.NoError(<-done)
+}
+
+func TestReconnectingBuffersWritesWhileDisconnected(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(1)
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	reconnecting := NewReconnectingWithRetrier(retrier, 1, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = reconnecting.Consume(ctx)
+	}()
+	waitForWaiters(t, clock, 1)
+	require.NoError(reconnecting.Write([]byte("first")))
+	require.Equal(ErrNotConnected, reconnecting.Write([]byte("second")), "buffer overflow is not reported")
+	clock.Advance(time.Minute)
+
+	deadline := time.Now().Add(time.Second)
+	for len(src.Written()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal([]string{"first"}, src.Written())
+	require.NoError(reconnecting.Write([]byte("third")))
+	require.Equal([]string{"first", "third"}, src.Written())
+}
+
+func TestReconnectingRetriesFailedTCPDials(t *testing.T) {
+	require := requirement.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	addr := listener.Addr().String()
+	require.NoError(listener.Close()) // nobody listens anymore, dials are refused
+
+	clock := NewFakeClock(time.Unix(0, 0))
+	tries := 2
+	policy := RetryPolicy{Tries: &tries, Backoff: ConstantBackoff{Delay: time.Minute}}
+	retrier := NewRetrierWithClock(NewTCP(addr, logutil.DummyLogger), policy, clock, logutil.DummyLogger)
+	reconnecting := NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger)
+	done := make(chan error)
+	go func() {
+		done <- reconnecting.Consume(context.Background())
+	}()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+	err = <-done
+	require.Error(err)
+	require.False(IsFatal(err), "refused dial gave up reconnecting")
+}
+
+func TestReconnectingKeepsClassifierOfRetrier(t *testing.T) {
+	require := requirement.New(t)
+	classifier := ClassifierFunc(func(err error, statusCode int) Classification {
+		return Classification{Class: FailureFatal}
+	})
+	retrier := NewRetrier(NewNetworkSourceMock(0), RetryPolicy{Classifier: classifier}, logutil.DummyLogger)
+	reconnecting := NewReconnectingWithRetrier(retrier, 0, logutil.DummyLogger)
+
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	require.Equal(FailureFatal, retrier.policy.Classifier.Classify(dialErr, 0).Class, "classifier of the retrier changed")
+	require.Equal(FailureRetryable, reconnecting.Retrier().policy.Classifier.Classify(dialErr, 0).Class)
+}
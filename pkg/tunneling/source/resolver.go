@@ -0,0 +1,195 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver turns the address a source was created with (host:port) into the list
+// of addresses to dial. Sources call it on every Connect, so a reconnect picks up
+// the addresses that changed since the previous one.
+type Resolver interface {
+	Resolve(ctx context.Context, target string) (addrs []string, err error)
+}
+
+// ResolverFunc is an adapter to use ordinary functions as Resolver
+type ResolverFunc func(ctx context.Context, target string) ([]string, error)
+
+func (f ResolverFunc) Resolve(ctx context.Context, target string) ([]string, error) {
+	return f(ctx, target)
+}
+
+// StaticResolver resolves any target to the fixed list of addresses
+type StaticResolver []string
+
+func (addrs StaticResolver) Resolve(ctx context.Context, target string) ([]string, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", target)
+	}
+	return addrs, nil
+}
+
+// SRVResolver looks up DNS SRV records _Service._Proto.host for the host of
+// the target. Addresses are returned in the order of priority, randomized by weight.
+type SRVResolver struct {
+	Service string
+	Proto   string
+	// Resolver is used for lookups, net.DefaultResolver if nil
+	Resolver *net.Resolver
+}
+
+func (srv SRVResolver) Resolve(ctx context.Context, target string) ([]string, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	resolver := srv.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, srv.Service, srv.Proto, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no srv records for %s", host)
+	}
+	return addrs, nil
+}
+
+// FileResolver resolves any target to the addresses listed in a file, one per line
+// (empty lines and lines starting with # are skipped). The file is read again
+// whenever its modification time changes.
+type FileResolver struct {
+	path    string
+	mx      sync.Mutex
+	modTime time.Time
+	addrs   []string
+}
+
+func NewFileResolver(path string) *FileResolver {
+	return &FileResolver{path: path}
+}
+
+func (file *FileResolver) Resolve(ctx context.Context, target string) ([]string, error) {
+	file.mx.Lock()
+	defer file.mx.Unlock()
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(file.modTime) || file.addrs == nil {
+		addrs, err := readAddrs(file.path)
+		if err != nil {
+			return nil, err
+		}
+		file.addrs = addrs
+		file.modTime = info.ModTime()
+	}
+	if len(file.addrs) == 0 {
+		return nil, fmt.Errorf("no addresses in %s", file.path)
+	}
+	return file.addrs, nil
+}
+
+func readAddrs(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	addrs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, scanner.Err()
+}
+
+// FakeResolver resolves targets to whatever was Set for them, so that
+// resolution can be tested offline
+type FakeResolver struct {
+	mx      sync.Mutex
+	results map[string][]string
+	err     error
+	calls   int
+}
+
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{results: make(map[string][]string)}
+}
+
+func (fake *FakeResolver) Set(target string, addrs ...string) {
+	fake.mx.Lock()
+	defer fake.mx.Unlock()
+	fake.results[target] = addrs
+}
+
+// SetError makes every following Resolve fail with err (nil to stop failing)
+func (fake *FakeResolver) SetError(err error) {
+	fake.mx.Lock()
+	defer fake.mx.Unlock()
+	fake.err = err
+}
+
+// Calls returns how many times Resolve was called
+func (fake *FakeResolver) Calls() int {
+	fake.mx.Lock()
+	defer fake.mx.Unlock()
+	return fake.calls
+}
+
+func (fake *FakeResolver) Resolve(ctx context.Context, target string) ([]string, error) {
+	fake.mx.Lock()
+	defer fake.mx.Unlock()
+	fake.calls++
+	if fake.err != nil {
+		return nil, fake.err
+	}
+	addrs, ok := fake.results[target]
+	if !ok {
+		return nil, fmt.Errorf("fake resolver knows nothing about %s", target)
+	}
+	return addrs, nil
+}
+
+// resolvingDialContext returns a dial function that resolves the address with
+// resolver and dials the resolved addresses one by one until one of them connects
+func resolvingDialContext(
+	resolver Resolver, dialer *net.Dialer,
+) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		addrs, err := resolver.Resolve(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %w", addr, err)
+		}
+		var lastErr error
+		for _, resolved := range addrs {
+			conn, err := dialer.DialContext(ctx, network, resolved)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, fmt.Errorf("cannot dial any of %v: %w", addrs, lastErr)
+	}
+}
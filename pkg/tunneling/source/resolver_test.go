@@ -0,0 +1,59 @@
+package source
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileResolverReloadsChangedFile(t *testing.T) {
+	require := requirement.New(t)
+	path := filepath.Join(t.TempDir(), "endpoints")
+	require.NoError(os.WriteFile(path, []byte("# relays\n10.0.0.1:80\n\n10.0.0.2:80\n"), 0644))
+	resolver := NewFileResolver(path)
+
+	addrs, err := resolver.Resolve(context.Background(), "relay:80")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.1:80", "10.0.0.2:80"}, addrs)
+
+	require.NoError(os.WriteFile(path, []byte("10.0.0.3:80\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(os.Chtimes(path, later, later))
+	addrs, err = resolver.Resolve(context.Background(), "relay:80")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.3:80"}, addrs)
+}
+
+func TestTCPResolvesOnEveryConnect(t *testing.T) {
+	require := requirement.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	resolver := NewFakeResolver()
+	resolver.Set("relay:80", "127.0.0.1:1", listener.Addr().String())
+	tcp := NewTCPWithResolver("relay:80", resolver, logutil.DummyLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(tcp.Connect(ctx), "tcp did not fall back to the second resolved address")
+	cancel()
+
+	resolver.SetError(os.ErrNotExist)
+	err = tcp.Connect(context.Background())
+	require.Error(err)
+	require.False(IsFatal(err), "resolution failure must be retryable")
+	require.Equal(2, resolver.Calls())
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"github.com/sirupsen/logrus"
+	"math"
 	"math/rand"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,10 +16,10 @@ type RetryPolicy struct {
 	// If null - retrier will try to connect infinitely
 	Tries *int
 	// Delay is a number in seconds that used to increase the timeout between tries.
-	// (retrier uses arithmetical progression)
+	// (retrier uses arithmetical progression). Ignored if Backoff is set
 	Delay float64
 	// MaxTimeout is a number in seconds that defines maximum delay between tries.
-	// Use math.Inf(1) if you don't want to have such limit
+	// Use math.Inf(1) if you don't want to have such limit. Ignored if Backoff is set
 	MaxTimeout float64
 	// JitterFunc is a function that returns a small divergent number by which
 	// each delay timeout is multiplied.
@@ -25,6 +27,44 @@ type RetryPolicy struct {
 	// after manager restarts.
 	// Use
 	JitterFunc func() float64
+	// Backoff computes the delay before each next attempt. If nil - LinearBackoff
+	// built from Delay, MaxTimeout and JitterFunc is used.
+	Backoff Backoff
+	// ResetAfter is how long a connection has to live to be considered stable:
+	// when a stable connection breaks, delays start over from the first one.
+	// 0 means delays are never reset
+	ResetAfter time.Duration
+	// Classifier decides whether a connect error is fatal, retryable or rate limited.
+	// If nil - NewDefaultClassifier with the clock of the retrier is used
+	Classifier Classifier
+	// Breaker is an optional circuit breaker, share it between retriers
+	// connecting to the same target
+	Breaker *CircuitBreaker
+	// Budget optionally limits the number of retries, share it between retriers
+	// connecting to the same target
+	Budget *RetryBudget
+}
+
+func (policy RetryPolicy) classifier(clock Clock) Classifier {
+	if policy.Classifier != nil {
+		return policy.Classifier
+	}
+	return NewDefaultClassifier(clock)
+}
+
+func (policy RetryPolicy) backoff() Backoff {
+	if policy.Backoff != nil {
+		return policy.Backoff
+	}
+	var max time.Duration
+	if !math.IsInf(policy.MaxTimeout, 1) {
+		max = time.Duration(policy.MaxTimeout * float64(time.Second))
+	}
+	return LinearBackoff{
+		Step:       time.Duration(policy.Delay * float64(time.Second)),
+		Max:        max,
+		JitterFunc: policy.JitterFunc,
+	}
 }
 
 // DefaultRetryPolicy is a policy with all fields set to the default values
@@ -33,34 +73,103 @@ var DefaultRetryPolicy = RetryPolicy{
 	Delay:      1,   // increase delay by 1 each time
 	MaxTimeout: 60,  // don't let timeout be more than 60 sec
 	JitterFunc: rand.ExpFloat64,
+	ResetAfter: time.Minute, // connection that lived a minute reconnects without delay growth
 }
 
 type Retrier struct {
 	NetworkSource
-	policy RetryPolicy
-	logger *logrus.Logger
+	policy      RetryPolicy
+	clock       Clock
+	mx          sync.Mutex
+	nextAttempt time.Time
+	logger      *logrus.Logger
 }
 
 func NewRetrier(source NetworkSource, policy RetryPolicy, logger *logrus.Logger) *Retrier {
-	return &Retrier{NetworkSource: source, policy: policy, logger: logger}
+	return NewRetrierWithClock(source, policy, RealClock, logger)
 }
 
-func (retrier *Retrier) getTimeoutFunc() func() (next float64) {
-	var timeout float64 = 0
-	return func() (next float64) {
-		jitter := retrier.policy.JitterFunc()
-		timeout += retrier.policy.Delay * jitter
-		if timeout > retrier.policy.MaxTimeout {
-			return retrier.policy.MaxTimeout + 1*jitter
-		}
+func NewRetrierWithClock(source NetworkSource, policy RetryPolicy, clock Clock, logger *logrus.Logger) *Retrier {
+	return &Retrier{NetworkSource: source, policy: policy, clock: clock, logger: logger}
+}
+
+func (retrier *Retrier) getTimeoutFunc() func() (next time.Duration) {
+	backoff := retrier.policy.backoff()
+	attempt := 0
+	var timeout time.Duration = 0
+	return func() (next time.Duration) {
+		attempt++
+		timeout = backoff.Next(attempt, timeout)
 		return timeout
 	}
 }
 
+// NextAttempt returns the time when retrier is going to make its next attempt.
+// waiting is false if retrier is not sleeping between attempts at the moment
+func (retrier *Retrier) NextAttempt() (at time.Time, waiting bool) {
+	retrier.mx.Lock()
+	defer retrier.mx.Unlock()
+	return retrier.nextAttempt, !retrier.nextAttempt.IsZero()
+}
+
+func (retrier *Retrier) setNextAttempt(at time.Time) {
+	retrier.mx.Lock()
+	retrier.nextAttempt = at
+	retrier.mx.Unlock()
+}
+
+// wait sleeps for the given delay. It returns false if ctx was done earlier
+func (retrier *Retrier) wait(ctx context.Context, delay time.Duration) (completed bool) {
+	retrier.setNextAttempt(retrier.clock.Now().Add(delay))
+	defer retrier.setNextAttempt(time.Time{})
+	select {
+	case <-ctx.Done():
+		return false
+	case <-retrier.clock.After(delay):
+		return true
+	}
+}
+
+// admit checks the circuit breaker and (for retries) the retry budget of the policy.
+// If the attempt is not allowed, it returns how long to wait before asking again
+func (retrier *Retrier) admit(retry bool) (allowed bool, retryIn time.Duration, err error) {
+	breaker := retrier.policy.Breaker
+	if breaker != nil {
+		allowed, retryIn = breaker.Allow()
+		if !allowed {
+			return false, retryIn, nil
+		}
+	}
+	if retry && retrier.policy.Budget != nil {
+		allowed, retryIn = retrier.policy.Budget.Withdraw()
+		if !allowed && breaker != nil {
+			// no attempt is made, so no outcome would ever free the probe
+			breaker.Release()
+		}
+		if !allowed && retryIn == 0 {
+			return false, 0, errors.New("retry budget exhausted")
+		}
+		return allowed, retryIn, nil
+	}
+	return true, 0, nil
+}
+
+func (retrier *Retrier) recordResult(err error) {
+	if retrier.policy.Breaker == nil {
+		return
+	}
+	if err == nil {
+		retrier.policy.Breaker.Success()
+	} else {
+		retrier.policy.Breaker.Failure()
+	}
+}
+
 func (retrier *Retrier) Connect(ctx context.Context) (err error) {
 	i := 0
 	url := retrier.NetworkSource.GetUrl()
 	getTimeout := retrier.getTimeoutFunc()
+	classifier := retrier.policy.classifier(retrier.clock)
 	var maxTriesStr string
 	if retrier.policy.Tries == nil {
 		maxTriesStr = "inf"
@@ -72,6 +181,17 @@ func (retrier *Retrier) Connect(ctx context.Context) (err error) {
 		case <-ctx.Done():
 			return nil
 		default:
+			allowed, retryIn, err := retrier.admit(i > 0)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				retrier.logger.Debugf("retrier is not allowed to connect to %s for %s", url, retryIn)
+				if !retrier.wait(ctx, retryIn) {
+					return nil
+				}
+				continue
+			}
 			retrier.logger.Debugf(
 				"retrier connecting to source on %s, attempt %d/%s",
 				url, i+1, maxTriesStr)
@@ -82,25 +202,32 @@ func (retrier *Retrier) Connect(ctx context.Context) (err error) {
 				return nil
 			default:
 			}
-			if err != nil {
-				if fatalErr, ok := err.(*FatalConnectError); ok {
-					retrier.logger.Debugf("retrier error is fatal: %s", err)
-					return fatalErr
-				}
-				i++
-				retrier.logger.Errorf("retrier connect to source on %s failed: %s", url, err)
-				timeout := time.Duration(getTimeout())
-				time.Sleep(timeout * time.Second)
-				endlessRetry := retrier.policy.Tries == nil
-				if endlessRetry {
-					continue
-				}
-				triesExceeded := i >= *retrier.policy.Tries
-				if triesExceeded {
-					return errors.New("max reconnect attempts exceeded")
+			retrier.recordResult(err)
+			if err == nil {
+				return nil
+			}
+			classification := classifier.Classify(err, StatusCode(err))
+			if classification.Class == FailureFatal {
+				retrier.logger.Debugf("retrier error is fatal: %s", err)
+				if !IsFatal(err) {
+					return NewFatalConnectError(err)
 				}
+				return err
+			}
+			i++
+			retrier.logger.Errorf("retrier connect to source on %s failed (%s): %s",
+				url, classification.Class, err)
+			triesExceeded := retrier.policy.Tries != nil && i >= *retrier.policy.Tries
+			if triesExceeded {
+				return errors.New("max reconnect attempts exceeded")
+			}
+			timeout := getTimeout()
+			if classification.RetryAfter > timeout {
+				timeout = classification.RetryAfter
+			}
+			if !retrier.wait(ctx, timeout) {
+				return nil
 			}
-			return nil
 		}
 	}
 }
@@ -108,6 +235,7 @@ func (retrier *Retrier) Connect(ctx context.Context) (err error) {
 func (retrier *Retrier) Start(sessionCtx context.Context) error {
 	url := retrier.NetworkSource.GetUrl()
 	getTimeout := retrier.getTimeoutFunc()
+	connectedAt := retrier.clock.Now()
 	for {
 		select {
 		case <-sessionCtx.Done():
@@ -119,17 +247,24 @@ func (retrier *Retrier) Start(sessionCtx context.Context) error {
 				return nil
 			default:
 			}
+			if err == nil {
+				return nil
+			}
+			retrier.logger.Debugf("retier could not consume source on %s: %s", url, err.Error())
+			wasStable := retrier.policy.ResetAfter > 0 &&
+				retrier.clock.Now().Sub(connectedAt) >= retrier.policy.ResetAfter
+			if wasStable {
+				retrier.logger.Debugf("connection to %s was stable, resetting backoff", url)
+				getTimeout = retrier.getTimeoutFunc()
+			}
+			err = retrier.Connect(sessionCtx)
 			if err != nil {
-				retrier.logger.Debugf("retier could not consume source on %s: %s", url, err.Error())
-				err = retrier.Connect(sessionCtx)
-				if err != nil {
-					return err
-				}
-				timeout := time.Duration(getTimeout())
-				time.Sleep(timeout * time.Second)
-				continue
+				return err
+			}
+			connectedAt = retrier.clock.Now()
+			if !retrier.wait(sessionCtx, getTimeout()) {
+				return nil
 			}
-			return nil
 		}
 	}
 }
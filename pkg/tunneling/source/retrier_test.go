@@ -0,0 +1,85 @@
+package source
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+var constantPolicy = RetryPolicy{Backoff: ConstantBackoff{Delay: time.Minute}}
+
+func waitForWaiters(t *testing.T, clock *FakeClock, n int) {
+	deadline := time.Now().Add(time.Second)
+	for clock.Waiters() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody started waiting on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetrierConnectWaitsOnClock(t *testing.T) {
+	require := requirement.New(t)
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(2)
+	retrier := NewRetrierWithClock(src, constantPolicy, clock, logutil.DummyLogger)
+	done := make(chan error)
+
+	go func() {
+		done <- retrier.Connect(context.Background())
+	}()
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		waitForWaiters(t, clock, 1)
+		require.Equal(attempt, src.Connects())
+		at, waiting := retrier.NextAttempt()
+		require.True(waiting)
+		require.Equal(clock.Now().Add(time.Minute), at)
+		clock.Advance(time.Minute)
+	}
+	require.NoError(<-done)
+	require.Equal(3, src.Connects())
+	_, waiting := retrier.NextAttempt()
+	require.False(waiting)
+}
+
+func TestRetrierConnectStopsWaitingOnContextCancel(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	retrier := NewRetrierWithClock(NewNetworkSourceMock(100), constantPolicy, clock, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- retrier.Connect(ctx)
+	}()
+	waitForWaiters(t, clock, 1)
+	cancel()
+
+	select {
+	case err := <-done:
+		requirement.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("retrier.Connect() kept sleeping after context cancel")
+	}
+}
+
+func TestRetrierConnectGivesUpAfterTries(t *testing.T) {
+	tries := 2
+	policy := constantPolicy
+	policy.Tries = &tries
+	clock := NewFakeClock(time.Unix(0, 0))
+	src := NewNetworkSourceMock(100)
+	retrier := NewRetrierWithClock(src, policy, clock, logutil.DummyLogger)
+	done := make(chan error)
+
+	go func() {
+		done <- retrier.Connect(context.Background())
+	}()
+	waitForWaiters(t, clock, 1)
+	clock.Advance(time.Minute)
+
+	requirement.Error(t, <-done)
+	requirement.Equal(t, 2, src.Connects())
+}
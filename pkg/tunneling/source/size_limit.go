@@ -0,0 +1,169 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// ReadLimiter is implemented by sources that can refuse big messages themselves
+// (ws sources do it by closing the connection with code 1009)
+type ReadLimiter interface {
+	SetReadLimit(limit int64)
+}
+
+// CloseCoder is implemented by sources whose connection can be closed with
+// a status code (ws sources)
+type CloseCoder interface {
+	CloseWithCode(code int, text string) error
+}
+
+// Closer is implemented by sources whose connection can be closed, calling
+// Close again must do no harm
+type Closer interface {
+	Close()
+}
+
+func sendClose(conn *websocket.Conn, code int, text string) error {
+	deadline := time.Now().Add(time.Second)
+	return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+}
+
+type OversizeAction int
+
+const (
+	// OversizeDrop skips oversized messages
+	OversizeDrop OversizeAction = iota
+	// OversizeTruncate cuts oversized messages to the limit
+	OversizeTruncate
+	// OversizeSplit splits oversized messages into chunks of the limit size
+	OversizeSplit
+	// OversizeClose closes the source that sent an oversized message, with code
+	// 1009 (message too big) if it is a CloseCoder, otherwise with Close if it is
+	// a Closer, as the wrapped sources may not stop on ctx. For ReadLimiter sources the
+	// limit is set right on the source, so oversized messages are not even read.
+	// Oversized messages written to the source are refused with ErrMessageTooBig,
+	// the source did nothing wrong, so it is not closed.
+	OversizeClose
+)
+
+// SizeLimit configures SizeLimited, zero limits mean no limit
+type SizeLimit struct {
+	MaxInbound  int
+	MaxOutbound int
+	Action      OversizeAction
+}
+
+// SizeLimited is a Source that limits the size of messages read from and
+// written to the wrapped source
+type SizeLimited struct {
+	Source
+	limit  SizeLimit
+	reader chan []byte
+	logger *logrus.Logger
+}
+
+// NewSizeLimited wraps src. The read limit of ReadLimiter sources is set only
+// with OversizeClose, as they close the connection on oversized messages, while
+// the other actions need the messages read to drop, truncate or split them.
+func NewSizeLimited(src Source, limit SizeLimit, logger *logrus.Logger) *SizeLimited {
+	if readLimiter, ok := src.(ReadLimiter); ok && limit.Action == OversizeClose && limit.MaxInbound > 0 {
+		readLimiter.SetReadLimit(int64(limit.MaxInbound))
+	}
+	return &SizeLimited{
+		Source: src,
+		limit:  limit,
+		reader: make(chan []byte),
+		logger: logger,
+	}
+}
+
+func (limited *SizeLimited) GetReader() chan []byte {
+	return limited.reader
+}
+
+// Labels passes through the labels of the wrapped source
+func (limited *SizeLimited) Labels() Labels {
+	return LabelsOf(limited.Source)
+}
+
+// Connect connects the wrapped source if it is a NetworkSource, so that
+// a limited NetworkSource is still one, e.g. for Retrier
+func (limited *SizeLimited) Connect(ctx context.Context) error {
+	networkSource, ok := limited.Source.(NetworkSource)
+	if !ok {
+		return errors.New("size limited source is not a network source")
+	}
+	return networkSource.Connect(ctx)
+}
+
+// GetUrl returns the url of the wrapped source, empty if it is not a NetworkSource
+func (limited *SizeLimited) GetUrl() string {
+	if networkSource, ok := limited.Source.(NetworkSource); ok {
+		return networkSource.GetUrl()
+	}
+	return ""
+}
+
+// Consume consumes the wrapped source passing its messages through the inbound limit.
+// With OversizeClose an oversized message ends Consume with ErrMessageTooBig.
+func (limited *SizeLimited) Consume(ctx context.Context) error {
+	return consumeThrough(ctx, limited.Source, limited.reader, func(msg []byte) ([][]byte, error) {
+		return limited.apply(msg, limited.limit.MaxInbound)
+	}, limited.close)
+}
+
+// Write writes msg passed through the outbound limit. With OversizeClose an
+// oversized message is not written and ErrMessageTooBig is returned, Transmitter
+// audits it as refused.
+func (limited *SizeLimited) Write(msg []byte) error {
+	chunks, err := limited.apply(msg, limited.limit.MaxOutbound)
+	if err != nil {
+		limited.logger.Infof("refusing to write: %s", err)
+		return err
+	}
+	for _, chunk := range chunks {
+		if err := limited.Source.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply returns what has to be sent instead of msg according to the limit
+func (limited *SizeLimited) apply(msg []byte, limit int) ([][]byte, error) {
+	if limit <= 0 || len(msg) <= limit {
+		return [][]byte{msg}, nil
+	}
+	limited.logger.Debugf("message of %d bytes exceeds limit of %d", len(msg), limit)
+	switch limited.limit.Action {
+	case OversizeTruncate:
+		return [][]byte{msg[:limit]}, nil
+	case OversizeSplit:
+		chunks := make([][]byte, 0, (len(msg)+limit-1)/limit)
+		for len(msg) > limit {
+			chunks = append(chunks, msg[:limit])
+			msg = msg[limit:]
+		}
+		return append(chunks, msg), nil
+	case OversizeClose:
+		return nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooBig, len(msg), limit)
+	}
+	return nil, nil
+}
+
+func (limited *SizeLimited) close(err error) {
+	limited.logger.Infof("closing source: %s", err)
+	switch src := limited.Source.(type) {
+	case CloseCoder:
+		// the peer closes the connection in reply, which ends Consume
+		if err := src.CloseWithCode(websocket.CloseMessageTooBig, "message too big"); err != nil {
+			limited.logger.Errorf("could not send close frame: %s", err)
+		}
+	case Closer:
+		src.Close()
+	}
+}
@@ -0,0 +1,136 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/gorilla/websocket"
+	requirement "github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSizeLimitedSplitsAndTruncates(t *testing.T) {
+	require := requirement.New(t)
+	src := NewNetworkSourceMock(0)
+	src.messages = []string{"0123456789"}
+	limited := NewSizeLimited(src, SizeLimit{MaxInbound: 4, MaxOutbound: 3, Action: OversizeSplit}, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		_ = limited.Consume(ctx)
+	}()
+	reader := limited.GetReader()
+	require.Equal("0123", string(<-reader))
+	require.Equal("4567", string(<-reader))
+	require.Equal("89", string(<-reader))
+
+	require.NoError(limited.Write([]byte("abcdefg")))
+	require.Equal([]string{"abc", "def", "g"}, src.Written())
+
+	truncated := NewSizeLimited(src, SizeLimit{MaxOutbound: 2, Action: OversizeTruncate}, logutil.DummyLogger)
+	require.NoError(truncated.Write([]byte("xyz")))
+	require.Equal("xy", src.Written()[3])
+}
+
+func TestSizeLimitedClosesWSWithCode1009(t *testing.T) {
+	require := requirement.New(t)
+	closeCodes := make(chan int, 1)
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					closeCodes <- closeErr.Code
+				}
+				return
+			}
+			if conn.WriteMessage(msgType, msg) != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+	ws := NewWS(wsUrl(server), websocket.TextMessage, nil, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(ws.Connect(ctx))
+	limited := NewSizeLimited(ws, SizeLimit{MaxInbound: 4, Action: OversizeClose}, logutil.DummyLogger)
+
+	require.NoError(ws.Write([]byte("too big for the limit"))) // echoed back by the server
+	err := limited.Consume(ctx)
+	require.True(errors.Is(err, ErrMessageTooBig), "unexpected error %v", err)
+	select {
+	case code := <-closeCodes:
+		require.Equal(websocket.CloseMessageTooBig, code)
+	case <-time.After(time.Second):
+		t.Fatal("peer did not get the close frame")
+	}
+}
+
+func TestSizeLimitedClosesTCP(t *testing.T) {
+	require := requirement.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer listener.Close()
+	peerDone := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			peerDone <- err
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("too big for the limit"))
+		// blocks until the connection is closed by the other side
+		_, err = io.Copy(ioutil.Discard, conn)
+		peerDone <- err
+	}()
+
+	tcp := NewTCP(listener.Addr().String(), logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(tcp.Connect(ctx))
+	limited := NewSizeLimited(tcp, SizeLimit{MaxInbound: 4, Action: OversizeClose}, logutil.DummyLogger)
+	consumed := make(chan error, 1)
+	go func() { consumed <- limited.Consume(ctx) }()
+	select {
+	case err := <-consumed:
+		require.True(errors.Is(err, ErrMessageTooBig), "unexpected error %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Consume did not return after an oversized message")
+	}
+	select {
+	case err := <-peerDone:
+		require.NoError(err, "peer did not see the connection closed")
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+}
+
+func TestSizeLimitedRefusesOversizedWritesWithoutClosing(t *testing.T) {
+	require := requirement.New(t)
+	src := NewNetworkSourceMock(0)
+	limited := NewSizeLimited(src, SizeLimit{MaxOutbound: 4, Action: OversizeClose}, logutil.DummyLogger)
+	var _ NetworkSource = limited
+	require.NoError(limited.Connect(context.Background()))
+	require.Equal(src.GetUrl(), limited.GetUrl())
+
+	err := limited.Write([]byte("too big"))
+	require.True(errors.Is(err, ErrMessageTooBig), "unexpected error %v", err)
+	require.NoError(limited.Write([]byte("fits")), "recipient of an oversized message was closed")
+	require.Equal([]string{"fits"}, src.Written())
+}
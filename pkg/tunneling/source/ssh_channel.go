@@ -0,0 +1,77 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync"
+)
+
+// SSHChannel is a Source reading and writing an ssh channel accepted or opened
+// by a server, e.g. a forwarded connection
+type SSHChannel struct {
+	channel   ssh.Channel
+	reader    chan []byte
+	labels    Labels
+	closeOnce sync.Once
+	logger    *logrus.Logger
+}
+
+func NewSSHChannel(channel ssh.Channel, labels Labels, logger *logrus.Logger) *SSHChannel {
+	return &SSHChannel{
+		channel: channel,
+		reader:  make(chan []byte),
+		labels:  labels,
+		logger:  logger,
+	}
+}
+
+func (channel *SSHChannel) Labels() Labels {
+	return channel.labels
+}
+
+func (channel *SSHChannel) GetReader() chan []byte {
+	return channel.reader
+}
+
+// Consume reads the channel until the peer closes it (which is not an error)
+// or ctx is done
+func (channel *SSHChannel) Consume(ctx context.Context) error {
+	defer channel.logger.Debugln("sshChannel.Consume() ends")
+	go func() {
+		<-ctx.Done()
+		channel.Close()
+	}()
+	for {
+		buffer := make([]byte, 1024)
+		n, err := channel.channel.Read(buffer)
+		if n > 0 {
+			select {
+			case channel.reader <- buffer[:n]:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return NewReadError("ssh channel", err)
+		}
+	}
+}
+
+func (channel *SSHChannel) Write(msg []byte) error {
+	_, err := channel.channel.Write(msg)
+	return err
+}
+
+func (channel *SSHChannel) Close() {
+	channel.closeOnce.Do(func() {
+		if err := channel.channel.Close(); err != nil && !errors.Is(err, io.EOF) {
+			channel.logger.Errorln("Could not close ssh channel:", err)
+		}
+	})
+}
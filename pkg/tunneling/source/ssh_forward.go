@@ -0,0 +1,240 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultSSHTimeout is used when SSHOptions.Timeout is not set
+const DefaultSSHTimeout = 10 * time.Second
+
+type SSHOptions struct {
+	User string
+	// Auth are the methods to authenticate with, e.g. ssh.PublicKeys(signer) or
+	// ssh.PublicKeysCallback(agentClient.Signers) to use the keys of ssh-agent
+	Auth []ssh.AuthMethod
+	// HostKeyCallback verifies the key of the server, Connect fails if it is nil
+	HostKeyCallback ssh.HostKeyCallback
+	// Timeout limits dialing and the ssh handshake, DefaultSSHTimeout if 0
+	Timeout time.Duration
+	// Resolver resolves the address of the server, as for TCP
+	Resolver Resolver
+}
+
+// SSHForward is a NetworkSource that connects to an ssh server and asks it to
+// open a connection to the target (as `ssh -L` does), reading and writing
+// the bytes of that connection.
+type SSHForward struct {
+	url     string
+	target  string
+	options SSHOptions
+	client  *ssh.Client
+	conn    net.Conn
+	reader  *connReader
+	logger  *logrus.Logger
+}
+
+// NewSSHForward creates SSHForward to target (host:port as the ssh server sees
+// it) through the ssh server on url (host:port)
+func NewSSHForward(url string, target string, options SSHOptions, logger *logrus.Logger) *SSHForward {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultSSHTimeout
+	}
+	return &SSHForward{
+		url:     url,
+		target:  target,
+		options: options,
+		reader:  newConnReader(),
+		logger:  logger,
+	}
+}
+
+func (forward *SSHForward) GetUrl() string {
+	return forward.url
+}
+
+// Target is the address the ssh server connects to
+func (forward *SSHForward) Target() string {
+	return forward.target
+}
+
+func (forward *SSHForward) GetReader() chan []byte {
+	return forward.reader.get()
+}
+
+// Connect fails fatally if the server cannot be trusted, we cannot authenticate
+// or the server prohibits forwarding to the target. Failing to reach the server
+// or the target is not fatal.
+func (forward *SSHForward) Connect(ctx context.Context) error {
+	forward.logger.Infof("Connecting to %s through ssh on %s", forward.target, forward.url)
+	if forward.options.HostKeyCallback == nil {
+		return NewFatalConnectError(NewConnectError(forward.url, errors.New("ssh host key callback is not set")))
+	}
+	client, err := forward.dial(ctx)
+	if err != nil {
+		return err
+	}
+	conn, err := client.Dial("tcp", forward.target)
+	if err != nil {
+		client.Close()
+		connErr := NewConnectError(forward.url, fmt.Errorf("cannot open forwarding to %s: %w", forward.target, err))
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.Prohibited {
+			return NewFatalConnectError(connErr)
+		}
+		return connErr
+	}
+	forward.client = client
+	forward.conn = conn
+	forward.logger.Infof("Connected to %s through ssh on %s", forward.target, forward.url)
+	go func() {
+		<-ctx.Done()
+		forward.Close()
+	}()
+	return nil
+}
+
+func (forward *SSHForward) dial(ctx context.Context) (*ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: forward.options.Timeout}
+	dial := dialer.DialContext
+	if forward.options.Resolver != nil {
+		dial = resolvingDialContext(forward.options.Resolver, dialer)
+	}
+	conn, err := dial(ctx, "tcp", forward.url)
+	if err != nil {
+		return nil, NewConnectError(forward.url, wrapTimeout(forward.url, err))
+	}
+	// the handshake does not know about ctx, so limit it with the deadline
+	deadline := time.Now().Add(forward.options.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+
+	var hostKeyErr error
+	hostKeyChecked := false
+	config := &ssh.ClientConfig{
+		User: forward.options.User,
+		Auth: forward.options.Auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = forward.options.HostKeyCallback(hostname, remote, key)
+			hostKeyChecked = true
+			return hostKeyErr
+		},
+		Timeout: forward.options.Timeout,
+	}
+	// ssh only returns the text of its errors, so tell the connection failing
+	// from the server refusing us by the errors of the connection itself
+	recording := &errRecordingConn{Conn: conn}
+	sshConn, channels, requests, err := ssh.NewClientConn(recording, forward.url, config)
+	if err != nil {
+		conn.Close()
+		connErr := NewConnectError(forward.url, wrapTimeout(forward.url, err))
+		untrusted := hostKeyErr != nil
+		// after the server is trusted only authentication is left, which fails
+		// with the server rejecting our methods or with our methods failing
+		unauthenticated := hostKeyChecked && recording.err() == nil
+		if untrusted || unauthenticated {
+			return nil, NewFatalConnectError(connErr)
+		}
+		return nil, connErr
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+func (forward *SSHForward) Consume(ctx context.Context) error {
+	defer forward.logger.Debugln("sshForward.Consume() ends")
+	forward.logger.Debugln("sshForward.Consume() call")
+
+	// don't need to catch context done - we already created a goroutine in .Connect() method
+	// waiting for that
+	conn := forward.conn
+	reader, done, release := forward.reader.consume()
+	defer release()
+	for {
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			// closed ssh channels read EOF, whoever closed them
+			if IsClosedConnError(err) || ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, io.EOF) {
+				return NewPeerClosedError(forward.url, err)
+			}
+			return NewReadError(forward.url, err)
+		}
+		if !send(reader, done, buffer[:n]) {
+			return nil
+		}
+	}
+}
+
+func (forward *SSHForward) Write(msg []byte) error {
+	if _, err := forward.conn.Write(msg); err != nil {
+		return NewWriteError(forward.url, err)
+	}
+	return nil
+}
+
+func (forward *SSHForward) Close() {
+	defer forward.logger.Debugln("sshForward.Close() ends")
+	if err := forward.conn.Close(); err != nil {
+		forward.logger.Errorln("Could not close forwarded connection:", err)
+	}
+	if err := forward.client.Close(); err != nil {
+		forward.logger.Errorln("Could not close connection to ssh:", err)
+	}
+	// give the next Connect a fresh reader, as TCP does
+	forward.reader.close()
+}
+
+// errRecordingConn remembers the first error reading or writing the connection
+// before it is closed, as ssh closes it when the handshake fails
+type errRecordingConn struct {
+	net.Conn
+	mx       sync.Mutex
+	firstErr error
+	closed   bool
+}
+
+func (conn *errRecordingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.record(err)
+	return n, err
+}
+
+func (conn *errRecordingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.record(err)
+	return n, err
+}
+
+func (conn *errRecordingConn) Close() error {
+	conn.mx.Lock()
+	conn.closed = true
+	conn.mx.Unlock()
+	return conn.Conn.Close()
+}
+
+func (conn *errRecordingConn) record(err error) {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	if err != nil && !conn.closed && conn.firstErr == nil {
+		conn.firstErr = err
+	}
+}
+
+func (conn *errRecordingConn) err() error {
+	conn.mx.Lock()
+	defer conn.mx.Unlock()
+	return conn.firstErr
+}
@@ -0,0 +1,209 @@
+package source
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	requirement.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	requirement.NoError(t, err)
+	return signer
+}
+
+// newEchoServer starts a tcp server that sends every byte it gets back
+func newEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirement.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newForwardingSSHServer starts an ssh server that lets the user with the key
+// in and opens direct-tcpip channels to the allowed target only
+func newForwardingSSHServer(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey, allowedTarget string) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirement.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveForwarding(conn, config, allowedTarget)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveForwarding(conn net.Conn, config *ssh.ServerConfig, allowedTarget string) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &payload) != nil {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip")
+			continue
+		}
+		target := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+		if target != allowedTarget {
+			_ = newChannel.Reject(ssh.Prohibited, "forwarding is not allowed")
+			continue
+		}
+		backend, err := net.Dial("tcp", target)
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			backend.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			defer channel.Close()
+			_, _ = io.Copy(channel, backend)
+		}()
+		go func() {
+			defer backend.Close()
+			_, _ = io.Copy(backend, channel)
+		}()
+	}
+}
+
+func TestSSHForward(t *testing.T) {
+	require := requirement.New(t)
+	hostKey, userKey := newSSHSigner(t), newSSHSigner(t)
+	target := newEchoServer(t)
+	server := newForwardingSSHServer(t, hostKey, userKey.PublicKey(), target)
+	forward := NewSSHForward(server, target, SSHOptions{
+		User:            "tunnel",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(forward.Connect(ctx))
+	consumed := make(chan error, 1)
+	go func() { consumed <- forward.Consume(ctx) }()
+	require.NoError(forward.Write([]byte("through the bastion")))
+	require.Equal("through the bastion", string(<-forward.GetReader()))
+	cancel()
+	require.NoError(<-consumed)
+}
+
+func TestSSHForwardFatalErrors(t *testing.T) {
+	hostKey, userKey := newSSHSigner(t), newSSHSigner(t)
+	target := newEchoServer(t)
+	server := newForwardingSSHServer(t, hostKey, userKey.PublicKey(), target)
+	cases := map[string]struct {
+		target  string
+		options SSHOptions
+	}{
+		"unknown host key": {target, SSHOptions{
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+			HostKeyCallback: ssh.FixedHostKey(newSSHSigner(t).PublicKey()),
+		}},
+		"unknown user key": {target, SSHOptions{
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(newSSHSigner(t))},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		}},
+		"prohibited target": {"127.0.0.1:1", SSHOptions{
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		}},
+		"no host key callback": {target, SSHOptions{
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		}},
+	}
+	for name, c := range cases {
+		forward := NewSSHForward(server, c.target, c.options, logutil.DummyLogger)
+		err := forward.Connect(context.Background())
+		requirement.True(t, IsFatal(err), "%s: expected fatal error, got %v", name, err)
+	}
+}
+
+func TestSSHForwardUnreachableServerIsRetryable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirement.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	forward := NewSSHForward(addr, "127.0.0.1:80", SSHOptions{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, logutil.DummyLogger)
+	err = forward.Connect(context.Background())
+	requirement.Error(t, err)
+	requirement.False(t, IsFatal(err))
+}
+
+func TestSSHForwardDroppedDuringAuthIsRetryable(t *testing.T) {
+	hostKey, userKey := newSSHSigner(t), newSSHSigner(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirement.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		config := &ssh.ServerConfig{
+			PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+				conn.Close()
+				return nil, errors.New("dropped")
+			},
+		}
+		config.AddHostKey(hostKey)
+		_, _, _, _ = ssh.NewServerConn(conn, config)
+	}()
+	forward := NewSSHForward(listener.Addr().String(), "127.0.0.1:80", SSHOptions{
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(userKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	}, logutil.DummyLogger)
+	err = forward.Connect(context.Background())
+	requirement.Error(t, err)
+	requirement.False(t, IsFatal(err), "dropped connection is fatal: %v", err)
+}
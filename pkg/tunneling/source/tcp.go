@@ -3,25 +3,39 @@ package source
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
+// dialTimeout limits establishing tcp connections, of WS with a Resolver as well
+const dialTimeout = 5 * time.Second
+
 type TCP struct {
-	url    string
-	conn   *net.TCPConn
-	reader chan []byte
-	logger *logrus.Logger
+	url      string
+	mx       sync.Mutex // guards conn against closing it twice
+	conn     *net.TCPConn
+	reader   *connReader
+	resolver Resolver
+	logger   *logrus.Logger
 }
 
 func NewTCP(url string, logger *logrus.Logger) *TCP {
+	return NewTCPWithResolver(url, nil, logger)
+}
+
+// NewTCPWithResolver creates TCP that resolves url with resolver on every Connect.
+// With resolver set, failing to connect is not fatal, since the addresses
+// may change by the next attempt.
+func NewTCPWithResolver(url string, resolver Resolver, logger *logrus.Logger) *TCP {
 	return &TCP{
-		url:    url,
-		conn:   nil,
-		reader: make(chan []byte),
-		logger: logger,
+		url:      url,
+		conn:     nil,
+		reader:   newConnReader(),
+		resolver: resolver,
+		logger:   logger,
 	}
 }
 
@@ -30,23 +44,32 @@ func (tcp *TCP) GetUrl() string {
 }
 
 func (tcp *TCP) GetReader() chan []byte {
-	return tcp.reader
+	return tcp.reader.get()
 }
 
 func (tcp *TCP) Connect(ctx context.Context) error {
 	tcp.logger.Debugf("tcp.Connect() on %s", tcp.url)
 	tcp.logger.Infof("Connecting to tcp on %s", tcp.url)
-	dialer := net.Dialer{Timeout: 5 * time.Second}
-	conn, err := dialer.DialContext(ctx, "tcp", tcp.url)
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	dial := dialer.DialContext
+	if tcp.resolver != nil {
+		dial = resolvingDialContext(tcp.resolver, dialer)
+	}
+	conn, err := dial(ctx, "tcp", tcp.url)
 	if err != nil {
-		errMsg := fmt.Sprintf("tcp dial failed: %s", err.Error())
-		return NewFatalConnectError(errors.New(errMsg))
+		connErr := NewConnectError(tcp.url, wrapTimeout(tcp.url, err))
+		if tcp.resolver != nil {
+			return connErr
+		}
+		return NewFatalConnectError(connErr)
 	}
 	tcpConn, ok := conn.(*net.TCPConn)
 	if !ok {
 		panic("cannot convert to tcpConn")
 	}
+	tcp.mx.Lock()
 	tcp.conn = tcpConn
+	tcp.mx.Unlock()
 	tcp.logger.Infof("Connected to tcp on %s", tcp.url)
 	go func() {
 		<-ctx.Done()
@@ -61,34 +84,60 @@ func (tcp *TCP) Consume(ctx context.Context) error {
 
 	// don't need to catch context done - we already created a goroutine in .Connect() method
 	// waiting for that
+	tcp.mx.Lock()
+	conn := tcp.conn
+	tcp.mx.Unlock()
+	if conn == nil {
+		return nil // closed already
+	}
+	reader, done, release := tcp.reader.consume()
+	defer release()
 	for {
 		buffer := make([]byte, 1024)
-		n, err := tcp.conn.Read(buffer)
+		n, err := conn.Read(buffer)
 		if err != nil {
 			if IsClosedConnError(err) {
 				return nil
 			}
-			errMsg := fmt.Sprintf(
-				"Could not read from tcp on %s: %s", tcp.url, err,
-			)
-			return errors.New(errMsg)
+			if errors.Is(err, io.EOF) {
+				return NewPeerClosedError(tcp.url, err)
+			}
+			return NewReadError(tcp.url, wrapTimeout(tcp.url, err))
+		}
+		if !send(reader, done, buffer[:n]) {
+			return nil
 		}
-		tcp.reader <- buffer[:n]
 	}
 }
 
 func (tcp *TCP) Write(msg []byte) error {
-	_, err := tcp.conn.Write(msg)
-	return err
+	tcp.mx.Lock()
+	conn := tcp.conn
+	tcp.mx.Unlock()
+	if conn == nil {
+		return NewWriteError(tcp.url, ErrNotConnected)
+	}
+	_, err := conn.Write(msg)
+	if err != nil {
+		return NewWriteError(tcp.url, err)
+	}
+	return nil
 }
 
 func (tcp *TCP) Close() {
 	defer tcp.logger.Debugln("tcp.Close() ends")
 	tcp.logger.Debugln("tcp.Close() call")
+	tcp.mx.Lock()
+	defer tcp.mx.Unlock()
+	if tcp.conn == nil {
+		return // closed already
+	}
 	err := tcp.conn.Close()
 	if err != nil {
 		tcp.logger.Errorln("Could not close connection to tcp:", err)
 	}
 	tcp.conn = nil
-	close(tcp.reader)
+	// give the next Connect a fresh reader, the one handed out so far is closed
+	// to let its readers know this connection is over
+	tcp.reader.close()
 }
@@ -6,30 +6,34 @@ import (
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 type TCPConnection struct {
-	conn   net.Conn
-	reader chan []byte
-	logger *logrus.Logger
+	conn      net.Conn
+	reader    *connReader
+	closeOnce sync.Once
+	logger    *logrus.Logger
 }
 
 func NewTCPConnection(conn net.Conn, logger *logrus.Logger) *TCPConnection {
 	return &TCPConnection{
 		conn:   conn,
-		reader: make(chan []byte),
+		reader: newConnReader(),
 		logger: logger,
 	}
 }
 
 func (tcp *TCPConnection) GetReader() chan []byte {
-	return tcp.reader
+	return tcp.reader.get()
 }
 
 func (tcp *TCPConnection) Consume(ctx context.Context) (err error) {
 	defer tcp.logger.Debugln("tcpConn.Consume() ends")
 	tcp.logger.Debugln("tcpCOn.Consume()")
+	reader, done, release := tcp.reader.consume()
+	defer release()
 	for {
 		select {
 		case <-ctx.Done():
@@ -37,36 +41,39 @@ func (tcp *TCPConnection) Consume(ctx context.Context) (err error) {
 			return
 		default:
 			err := tcp.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if IsClosedConnError(err) {
+				return nil
+			}
 			if err != nil {
 				panic("cannot set deadline to tcpConn ")
 			}
 			buf := make([]byte, 1024)
 			n, err := tcp.conn.Read(buf)
 			if err != nil {
-				if err == io.EOF {
+				if errors.Is(err, io.EOF) || IsClosedConnError(err) {
 					return nil
 				}
-				netErr, ok := err.(net.Error)
-				isTimeout := ok && netErr.Timeout()
-				if isTimeout {
+				if IsTimeoutError(err) {
 					continue
 				}
-				return errors.New("Cannot read from tcp connection: " + err.Error())
+				return NewReadError(tcp.conn.RemoteAddr().String(), err)
+			}
+			if !send(reader, done, buf[:n]) {
+				return nil
 			}
-			message := buf[:n]
-			tcp.reader <- message
 		}
 	}
 }
 
 func (tcp *TCPConnection) Close() {
 	defer tcp.logger.Debugln("tcpConn.Close() ends")
-	err := tcp.conn.Close()
-	if err != nil {
-		tcp.logger.Errorln("Could not close connection to tcpConn:", err)
-	}
-	tcp.conn = nil
-	close(tcp.reader)
+	tcp.closeOnce.Do(func() {
+		err := tcp.conn.Close()
+		if err != nil {
+			tcp.logger.Errorln("Could not close connection to tcpConn:", err)
+		}
+		tcp.reader.close()
+	})
 }
 
 func (tcp *TCPConnection) Write(msg []byte) (err error) {
@@ -0,0 +1,42 @@
+package source
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	requirement "github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPCloseEndsConsumeNobodyReads(t *testing.T) {
+	require := requirement.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_, _ = conn.Write([]byte("unread"))
+		}
+	}()
+
+	tcp := NewTCP(listener.Addr().String(), logutil.DummyLogger)
+	require.NoError(tcp.Connect(context.Background()))
+	reader := tcp.GetReader()
+	done := make(chan error)
+	go func() {
+		done <- tcp.Consume(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond) // let Consume block sending the message
+	tcp.Close()
+	select {
+	case err := <-done:
+		require.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("Consume is stuck after Close")
+	}
+	_, open := <-reader
+	require.False(open, "reader of the closed connection is not closed")
+	require.NotEqual(reader, tcp.GetReader(), "no fresh reader for the next connection")
+}
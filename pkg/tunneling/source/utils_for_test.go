@@ -0,0 +1,135 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// NetworkSourceMock fails Connect the first failConnects times.
+// Every Consume sends messages to the reader and then returns the next error
+// from consumeErrs, blocking until the connection is closed when they run out.
+// Like real sources it closes its reader when the connect context is done.
+type NetworkSourceMock struct {
+	mx           sync.Mutex
+	reader       chan []byte
+	failConnects int
+	connects     int
+	connectErr   error
+	messages     []string
+	consumeErrs  []error
+	written      []string
+}
+
+func NewNetworkSourceMock(failConnects int, consumeErrs ...error) *NetworkSourceMock {
+	return &NetworkSourceMock{
+		reader:       make(chan []byte),
+		failConnects: failConnects,
+		connectErr:   NewConnectError("mock", errors.New("connection refused")),
+		consumeErrs:  consumeErrs,
+	}
+}
+
+func (s *NetworkSourceMock) Connect(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.connects++
+	if s.connects <= s.failConnects {
+		return s.connectErr
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return nil
+}
+
+func (s *NetworkSourceMock) Consume(ctx context.Context) error {
+	s.mx.Lock()
+	reader := s.reader
+	messages := s.messages
+	var err error
+	if len(s.consumeErrs) > 0 {
+		err = s.consumeErrs[0]
+		s.consumeErrs = s.consumeErrs[1:]
+	}
+	s.mx.Unlock()
+	for _, msg := range messages {
+		reader <- []byte(msg)
+	}
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (s *NetworkSourceMock) Close() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	closedReader := s.reader
+	s.reader = make(chan []byte)
+	close(closedReader)
+}
+
+func (s *NetworkSourceMock) GetReader() chan []byte {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.reader
+}
+
+func (s *NetworkSourceMock) Write(msg []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.written = append(s.written, string(msg))
+	return nil
+}
+
+func (s *NetworkSourceMock) GetUrl() string {
+	return "mock"
+}
+
+func (s *NetworkSourceMock) Connects() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.connects
+}
+
+func (s *NetworkSourceMock) Written() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]string{}, s.written...)
+}
+
+// pipeSource is one end of an in-memory connection made by newPipe
+type pipeSource struct {
+	reader chan []byte
+	peer   *pipeSource
+	chunk  int // splits written messages in chunks of that size, as stream sources do
+}
+
+// newPipe returns two sources, messages written to one are read from the other
+func newPipe() (*pipeSource, *pipeSource) {
+	a := &pipeSource{reader: make(chan []byte, 16)}
+	b := &pipeSource{reader: make(chan []byte, 16), peer: a}
+	a.peer = b
+	return a, b
+}
+
+func (p *pipeSource) Consume(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (p *pipeSource) GetReader() chan []byte {
+	return p.reader
+}
+
+func (p *pipeSource) Write(msg []byte) error {
+	for p.chunk > 0 && len(msg) > p.chunk {
+		p.peer.reader <- append([]byte{}, msg[:p.chunk]...)
+		msg = msg[p.chunk:]
+	}
+	p.peer.reader <- append([]byte{}, msg...)
+	return nil
+}
@@ -0,0 +1,50 @@
+package source
+
+import "context"
+
+// consumeThrough consumes src passing every message through transform and
+// sending the resulting messages to out. If transform fails, onFail is called,
+// src is stopped and the error is returned once src's Consume returns.
+func consumeThrough(
+	ctx context.Context, src Source, out chan []byte,
+	transform func(msg []byte) ([][]byte, error), onFail func(err error),
+) error {
+	innerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- src.Consume(innerCtx)
+	}()
+	reader := src.GetReader()
+	var failErr error
+	for {
+		select {
+		case err := <-consumed:
+			if failErr != nil {
+				return failErr
+			}
+			return err
+		case msg, ok := <-reader:
+			if !ok {
+				reader = nil // wait for Consume to return
+				continue
+			}
+			if failErr != nil {
+				continue // the source is closing, drop whatever is left
+			}
+			msgs, err := transform(msg)
+			if err != nil {
+				failErr = err
+				onFail(err)
+				cancel()
+				continue
+			}
+			for _, m := range msgs {
+				select {
+				case out <- m:
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+}
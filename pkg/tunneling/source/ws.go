@@ -7,7 +7,6 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"net/http"
-	"time"
 )
 
 type WSDialer interface {
@@ -16,19 +15,35 @@ type WSDialer interface {
 type WS struct {
 	url           string
 	conn          *websocket.Conn
-	reader        chan []byte
+	reader        *connReader
 	msgType       int
 	requestHeader http.Header
+	dialer        *websocket.Dialer
+	options       WSOptions
 	logger        *logrus.Logger
 }
 
 func NewWS(url string, msgType int, requestHeader http.Header, logger *logrus.Logger) *WS {
+	return NewWSWithOptions(url, msgType, WSOptions{RequestHeader: requestHeader}, logger)
+}
+
+// NewWSWithResolver creates WS that resolves the host of url with resolver on every
+// Connect. Host header and TLS server name still use the host from url.
+func NewWSWithResolver(url string, msgType int, requestHeader http.Header, resolver Resolver, logger *logrus.Logger) *WS {
+	options := WSOptions{RequestHeader: requestHeader, Resolver: resolver}
+	return NewWSWithOptions(url, msgType, options, logger)
+}
+
+// NewWSWithOptions creates WS with its own dialer configured by options
+func NewWSWithOptions(url string, msgType int, options WSOptions, logger *logrus.Logger) *WS {
 	return &WS{
 		url:           url,
 		conn:          nil,
-		reader:        make(chan []byte),
+		reader:        newConnReader(),
 		msgType:       msgType,
-		requestHeader: requestHeader,
+		requestHeader: options.header(),
+		dialer:        options.dialer(),
+		options:       options,
 		logger:        logger,
 	}
 }
@@ -44,29 +59,43 @@ func (ws *WS) GetUrl() string {
 	return ws.url
 }
 
+// Subprotocol returns the subprotocol chosen by the server during the last handshake
+func (ws *WS) Subprotocol() string {
+	if ws.conn == nil {
+		return ""
+	}
+	return ws.conn.Subprotocol()
+}
+
 func (ws *WS) GetReader() chan []byte {
-	return ws.reader
+	return ws.reader.get()
 }
 
 func (ws *WS) Connect(ctx context.Context) (err error) {
 	defer ws.logger.Infof("ws.Connect() on %s end", ws.url)
 	ws.logger.Infof("ws.Connect() on %s", ws.url)
 	// todo does dialContext close connection on ctx expiration as well ?
-	dialer := websocket.DefaultDialer
-	dialer.HandshakeTimeout = 10 * time.Second
-	conn, resp, err := dialer.DialContext(ctx, ws.url, ws.requestHeader)
+	conn, resp, err := ws.dial(ctx, false)
+	refreshCredentials := err != nil && resp != nil &&
+		resp.StatusCode == http.StatusUnauthorized && ws.options.Credentials != nil
+	if refreshCredentials {
+		ws.logger.Infof("ws on %s got 401, refreshing credentials", ws.url)
+		conn, resp, err = ws.dial(ctx, true)
+	}
 	if err != nil {
-		fatalResponseError := resp != nil && (resp.StatusCode == http.StatusBadRequest ||
-			resp.StatusCode == http.StatusUnauthorized)
-		if fatalResponseError {
-			errMsg := fmt.Sprintf(
-				"ws connection cannot connect to %s, response status is %d",
-				ws.url, resp.StatusCode,
-			)
-			return NewFatalConnectError(errors.New(errMsg))
+		if resp != nil {
+			connErr := NewConnectError(ws.url, NewHandshakeError(resp.StatusCode, resp.Header))
+			fatalResponseError := resp.StatusCode == http.StatusBadRequest ||
+				resp.StatusCode == http.StatusUnauthorized
+			if fatalResponseError {
+				return NewFatalConnectError(connErr)
+			}
+			return connErr
 		}
-		errMsg := fmt.Sprintf("Cannot connect to ws %s: %s", ws.url, err)
-		return errors.New(errMsg)
+		return NewConnectError(ws.url, wrapTimeout(ws.url, err))
+	}
+	if ws.options.MaxMessageSize > 0 {
+		conn.SetReadLimit(ws.options.MaxMessageSize)
 	}
 	ws.conn = conn
 	ws.logger.Infof("ws connected to %s", ws.url)
@@ -79,14 +108,33 @@ func (ws *WS) Connect(ctx context.Context) (err error) {
 	return nil
 }
 
+// dial makes the handshake, adding credentials if there is a provider
+func (ws *WS) dial(ctx context.Context, refresh bool) (*websocket.Conn, *http.Response, error) {
+	if ws.options.Credentials == nil {
+		return ws.dialer.DialContext(ctx, ws.url, ws.requestHeader)
+	}
+	credentials, err := ws.options.Credentials.Credentials(ctx, refresh)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get credentials: %w", err)
+	}
+	url, header, err := credentials.apply(ws.url, ws.requestHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ws.dialer.DialContext(ctx, url, header)
+}
+
 func (ws *WS) Consume(ctx context.Context) (err error) {
 	defer ws.logger.Debugln("ws.Consume() ends")
 	ws.logger.Debugf("ws.Consume() call %s", ws.url)
 
 	// don't need to catch context done - we already created a goroutine in .Connect() method
 	// waiting for that
+	conn := ws.conn
+	reader, done, release := ws.reader.consume()
+	defer release()
 	for {
-		_, message, err := ws.conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if IsClosedConnError(err) {
 				return nil
@@ -95,14 +143,47 @@ func (ws *WS) Consume(ctx context.Context) (err error) {
 			if normalClosure {
 				return nil
 			}
-			return errors.New(fmt.Sprintf("Cound not read from ws on %s: %s", ws.url, err))
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				return NewPeerClosedError(ws.url, err)
+			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				// the peer was already sent close frame with code 1009
+				return NewReadError(ws.url, ErrMessageTooBig)
+			}
+			return NewReadError(ws.url, wrapTimeout(ws.url, err))
+		}
+		if !send(reader, done, message) {
+			return nil
 		}
-		ws.reader <- message
 	}
 }
 
 func (ws *WS) Write(msg []byte) error {
-	return ws.conn.WriteMessage(ws.msgType, msg)
+	err := ws.conn.WriteMessage(ws.msgType, msg)
+	if err != nil {
+		return NewWriteError(ws.url, err)
+	}
+	return nil
+}
+
+// SetReadLimit limits the size of messages read from the connection. The peer that
+// sends a bigger message gets the connection closed with code 1009 and Consume
+// fails with ErrMessageTooBig. The limit is kept for the following connections.
+func (ws *WS) SetReadLimit(limit int64) {
+	ws.options.MaxMessageSize = limit
+	if ws.conn != nil {
+		ws.conn.SetReadLimit(limit)
+	}
+}
+
+// CloseWithCode sends close frame with the code to the peer, the connection
+// is closed once the peer answers or the connect context is done
+func (ws *WS) CloseWithCode(code int, text string) error {
+	if ws.conn == nil {
+		return ErrNotConnected
+	}
+	return sendClose(ws.conn, code, text)
 }
 
 func (ws *WS) Close() {
@@ -113,5 +194,7 @@ func (ws *WS) Close() {
 		ws.logger.Errorf("Could not close ws on %s: %s", ws.url, err)
 	}
 	ws.conn = nil
-	close(ws.reader)
+	// give the next Connect a fresh reader, the one handed out so far is closed
+	// to let its readers know this connection is over
+	ws.reader.close()
 }
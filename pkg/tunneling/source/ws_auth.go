@@ -0,0 +1,143 @@
+package source
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnauthenticated is returned by authenticators that could not find
+// valid credentials in the request
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Principal is the authenticated peer of a ws connection
+type Principal struct {
+	Name string
+	// Attributes are whatever the authenticator knows about the peer
+	// (e.g. the certificate issuer), may be nil
+	Attributes map[string]string
+}
+
+// Authenticator checks the credentials of an incoming ws handshake
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// AuthenticatorFunc is an adapter to use ordinary functions as Authenticator
+type AuthenticatorFunc func(r *http.Request) (Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Principal, error) {
+	return f(r)
+}
+
+// BearerAuthenticator authenticates "Authorization: Bearer <token>" header
+// by looking the token up with the function. Errors of the function are
+// returned wrapped in ErrUnauthenticated.
+type BearerAuthenticator func(ctx context.Context, token string) (Principal, error)
+
+func (lookup BearerAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	const prefix = "bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return Principal{}, ErrUnauthenticated
+	}
+	principal, err := lookup(r.Context(), strings.TrimSpace(header[len(prefix):]))
+	if err != nil && !errors.Is(err, ErrUnauthenticated) {
+		return Principal{}, fmt.Errorf("%w: %s", ErrUnauthenticated, err)
+	}
+	return principal, err
+}
+
+// Query parameters used by SignQuery and HMACQueryAuthenticator
+const (
+	QueryPrincipal = "principal"
+	QueryExpires   = "expires"
+	QuerySignature = "signature"
+)
+
+func signature(secret []byte, principal string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(principal + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignQuery returns query parameters that HMACQueryAuthenticator with the same
+// secret accepts until expiresAt. Use them as Credentials.Query on the client side
+func SignQuery(secret []byte, principal string, expiresAt time.Time) url.Values {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return url.Values{
+		QueryPrincipal: []string{principal},
+		QueryExpires:   []string{expires},
+		QuerySignature: []string{signature(secret, principal, expires)},
+	}
+}
+
+// HMACQueryAuthenticator authenticates requests with query signed by SignQuery
+type HMACQueryAuthenticator struct {
+	Secret []byte
+	// Clock is used to check expiry, RealClock if nil
+	Clock Clock
+}
+
+func (auth HMACQueryAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	query := r.URL.Query()
+	principal := query.Get(QueryPrincipal)
+	expires := query.Get(QueryExpires)
+	expected := signature(auth.Secret, principal, expires)
+	if principal == "" || !hmac.Equal([]byte(expected), []byte(query.Get(QuerySignature))) {
+		return Principal{}, ErrUnauthenticated
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return Principal{}, ErrUnauthenticated
+	}
+	clock := auth.Clock
+	if clock == nil {
+		clock = RealClock
+	}
+	if clock.Now().Unix() >= expiresAt {
+		return Principal{}, fmt.Errorf("%w: signature expired", ErrUnauthenticated)
+	}
+	return Principal{Name: principal}, nil
+}
+
+// ClientCertAuthenticator authenticates the peer by the verified TLS client
+// certificate, using its subject common name as the principal name.
+// The server must be configured to request and verify client certificates.
+type ClientCertAuthenticator struct{}
+
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Principal{}, ErrUnauthenticated
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	return Principal{
+		Name: cert.Subject.CommonName,
+		Attributes: map[string]string{
+			"issuer": cert.Issuer.CommonName,
+			"serial": cert.SerialNumber.String(),
+		},
+	}, nil
+}
+
+// AnyAuthenticator tries authenticators in order and uses the first
+// that succeeds
+func AnyAuthenticator(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (Principal, error) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(r)
+			if err == nil {
+				return principal, nil
+			}
+		}
+		return Principal{}, ErrUnauthenticated
+	})
+}
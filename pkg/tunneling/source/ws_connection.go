@@ -2,25 +2,54 @@ package source
 
 import (
 	"context"
+	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	"time"
 )
 
 type WSConn struct { // connection webSocket
-	conn    *websocket.Conn
-	reader  chan []byte
-	msgType int
-	logger  *logrus.Logger
+	conn      *websocket.Conn
+	reader    chan []byte
+	msgType   int
+	principal Principal
+	logger    *logrus.Logger
 }
 
 func NewWSConn(conn *websocket.Conn, msgType int, logger *logrus.Logger) *WSConn {
+	return NewAuthenticatedWSConn(conn, msgType, Principal{}, logger)
+}
+
+// NewAuthenticatedWSConn creates WSConn for a connection whose peer was authenticated
+// as principal, see UpgradeHandler
+func NewAuthenticatedWSConn(conn *websocket.Conn, msgType int, principal Principal, logger *logrus.Logger) *WSConn {
 	return &WSConn{
-		conn:    conn,
-		msgType: msgType,
-		reader:  make(chan []byte),
-		logger:  logger,
+		conn:      conn,
+		msgType:   msgType,
+		reader:    make(chan []byte),
+		principal: principal,
+		logger:    logger,
+	}
+}
+
+// Principal returns the authenticated peer, zero Principal if the connection
+// was not authenticated
+func (ws *WSConn) Principal() Principal {
+	return ws.principal
+}
+
+// Labels returns principal name and attributes of an authenticated connection.
+// An attribute named "principal" cannot override the name.
+func (ws *WSConn) Labels() Labels {
+	if ws.principal.Name == "" {
+		return nil
+	}
+	labels := make(Labels, len(ws.principal.Attributes)+1)
+	for key, value := range ws.principal.Attributes {
+		labels[key] = value
 	}
+	labels["principal"] = ws.principal.Name
+	return labels
 }
 
 func (ws *WSConn) GetReader() chan []byte {
@@ -43,6 +72,9 @@ func (ws *WSConn) Consume(ctx context.Context) (err error) {
 			if normalClosure {
 				return nil
 			}
+			if errors.Is(err, websocket.ErrReadLimit) {
+				return ErrMessageTooBig
+			}
 			return err
 		}
 		ws.reader <- message
@@ -53,6 +85,21 @@ func (ws *WSConn) Write(msg []byte) (err error) {
 	return ws.conn.WriteMessage(ws.msgType, msg)
 }
 
+// SetReadLimit limits the size of messages read from the connection,
+// see WS.SetReadLimit
+func (ws *WSConn) SetReadLimit(limit int64) {
+	ws.conn.SetReadLimit(limit)
+}
+
+// CloseWithCode sends close frame with the code to the peer, the connection
+// is closed once the peer answers or the consume context is done
+func (ws *WSConn) CloseWithCode(code int, text string) error {
+	if ws.conn == nil {
+		return ErrNotConnected
+	}
+	return sendClose(ws.conn, code, text)
+}
+
 func (ws *WSConn) Close() {
 	defer ws.logger.Debugln("wsConn.Close() ends")
 	if ws.conn == nil {
@@ -0,0 +1,75 @@
+package source
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultHandshakeTimeout is used when WSOptions.HandshakeTimeout is not set
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// WSOptions configures how WS dials and reads. Zero value gives the defaults
+// of websocket.DefaultDialer with DefaultHandshakeTimeout.
+type WSOptions struct {
+	// RequestHeader is sent with every handshake
+	RequestHeader http.Header
+	// Subprotocols are offered to the server, see WS.Subprotocol for the chosen one
+	Subprotocols []string
+	// EnableCompression negotiates permessage-deflate with the server
+	EnableCompression bool
+	// ReadBufferSize and WriteBufferSize are I/O buffer sizes in bytes,
+	// 0 means the websocket package default (4096)
+	ReadBufferSize  int
+	WriteBufferSize int
+	// MaxMessageSize is the read limit in bytes, 0 means no limit
+	MaxMessageSize int64
+	// TLSConfig is used for wss urls
+	TLSConfig *tls.Config
+	// Jar stores cookies set during the handshake and sends them on reconnect
+	Jar http.CookieJar
+	// Origin is sent as Origin header if not empty
+	Origin           string
+	HandshakeTimeout time.Duration
+	// Resolver resolves the host of the url on every Connect, see NewWSWithResolver
+	Resolver Resolver
+	// Credentials are asked for on every Connect and added to RequestHeader and
+	// url query. If the server answers 401, fresh credentials are requested and
+	// the handshake is repeated once.
+	Credentials CredentialsProvider
+}
+
+func (options WSOptions) dialer() *websocket.Dialer {
+	handshakeTimeout := options.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = DefaultHandshakeTimeout
+	}
+	dialer := &websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  handshakeTimeout,
+		ReadBufferSize:    options.ReadBufferSize,
+		WriteBufferSize:   options.WriteBufferSize,
+		TLSClientConfig:   options.TLSConfig,
+		Subprotocols:      options.Subprotocols,
+		EnableCompression: options.EnableCompression,
+		Jar:               options.Jar,
+	}
+	if options.Resolver != nil {
+		dialer.NetDialContext = resolvingDialContext(options.Resolver, &net.Dialer{Timeout: dialTimeout})
+	}
+	return dialer
+}
+
+func (options WSOptions) header() http.Header {
+	if options.Origin == "" {
+		return options.RequestHeader
+	}
+	header := options.RequestHeader.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Origin", options.Origin)
+	return header
+}
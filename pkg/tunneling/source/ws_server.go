@@ -0,0 +1,124 @@
+package source
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpgradeOptions configures UpgradeHandler
+type UpgradeOptions struct {
+	// Authenticator checks the handshake request, nil lets everybody in
+	Authenticator Authenticator
+	// AllowedOrigins lists origins (scheme://host[:port]) allowed to connect,
+	// "*" allows any. If empty, only requests without Origin header or with
+	// the origin equal to the request host are allowed.
+	AllowedOrigins []string
+	// Subprotocols are the subprotocols the server supports, in order of preference
+	Subprotocols []string
+	// NegotiateSubprotocol chooses the subprotocol out of the ones offered by
+	// the client. If nil, the first of Subprotocols offered by the client is chosen.
+	// Returning ok = false rejects the handshake.
+	NegotiateSubprotocol func(offered []string) (chosen string, ok bool)
+	// MsgType is the message type WSConn writes with
+	MsgType         int
+	ReadBufferSize  int
+	WriteBufferSize int
+}
+
+// UpgradeHandler is an http.Handler that authenticates ws handshakes, checks
+// their origin, negotiates the subprotocol and hands the resulting WSConn
+// to onConnect
+type UpgradeHandler struct {
+	options   UpgradeOptions
+	upgrader  websocket.Upgrader
+	onConnect func(conn *WSConn)
+	logger    *logrus.Logger
+}
+
+func NewUpgradeHandler(options UpgradeOptions, onConnect func(conn *WSConn), logger *logrus.Logger) *UpgradeHandler {
+	handler := &UpgradeHandler{
+		options:   options,
+		onConnect: onConnect,
+		logger:    logger,
+	}
+	handler.upgrader = websocket.Upgrader{
+		ReadBufferSize:  options.ReadBufferSize,
+		WriteBufferSize: options.WriteBufferSize,
+		// origin is checked by ServeHTTP before upgrading
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return handler
+}
+
+func (handler *UpgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.originAllowed(r) {
+		handler.logger.Infof("ws upgrade from %s rejected: origin %q is not allowed",
+			r.RemoteAddr, r.Header.Get("Origin"))
+		http.Error(w, "origin is not allowed", http.StatusForbidden)
+		return
+	}
+	var principal Principal
+	if handler.options.Authenticator != nil {
+		var err error
+		principal, err = handler.options.Authenticator.Authenticate(r)
+		if err != nil {
+			handler.logger.Infof("ws upgrade from %s rejected: %s", r.RemoteAddr, err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	responseHeader := http.Header{}
+	offered := websocket.Subprotocols(r)
+	if len(offered) > 0 {
+		subprotocol, ok := handler.negotiate(offered)
+		if !ok {
+			http.Error(w, "no supported subprotocol", http.StatusBadRequest)
+			return
+		}
+		if subprotocol != "" {
+			responseHeader.Set("Sec-Websocket-Protocol", subprotocol)
+		}
+	}
+	conn, err := handler.upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// upgrader has already replied with an error
+		handler.logger.Errorf("ws upgrade from %s failed: %s", r.RemoteAddr, err)
+		return
+	}
+	handler.logger.Infof("ws connection from %s authenticated as %q", r.RemoteAddr, principal.Name)
+	handler.onConnect(NewAuthenticatedWSConn(conn, handler.options.MsgType, principal, handler.logger))
+}
+
+func (handler *UpgradeHandler) negotiate(offered []string) (string, bool) {
+	if handler.options.NegotiateSubprotocol != nil {
+		return handler.options.NegotiateSubprotocol(offered)
+	}
+	for _, supported := range handler.options.Subprotocols {
+		for _, o := range offered {
+			if o == supported {
+				return supported, true
+			}
+		}
+	}
+	return "", len(handler.options.Subprotocols) == 0
+}
+
+func (handler *UpgradeHandler) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(handler.options.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range handler.options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
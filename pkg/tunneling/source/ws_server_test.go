@@ -0,0 +1,110 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/gorilla/websocket"
+	requirement "github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newUpgradeServer(t *testing.T, options UpgradeOptions) (*httptest.Server, chan *WSConn) {
+	conns := make(chan *WSConn, 1)
+	handler := NewUpgradeHandler(options, func(conn *WSConn) {
+		conns <- conn
+	}, logutil.DummyLogger)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, conns
+}
+
+func dialStatus(t *testing.T, url string, header http.Header, subprotocols ...string) (*websocket.Conn, int) {
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		if resp == nil {
+			t.Fatalf("dial failed without response: %s", err)
+		}
+		return nil, resp.StatusCode
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn, http.StatusSwitchingProtocols
+}
+
+func TestUpgradeHandlerAuthenticatesBearerToken(t *testing.T) {
+	require := requirement.New(t)
+	auth := BearerAuthenticator(func(ctx context.Context, token string) (Principal, error) {
+		if token != "secret" {
+			return Principal{}, errors.New("unknown token")
+		}
+		return Principal{Name: "agent-1"}, nil
+	})
+	server, conns := newUpgradeServer(t, UpgradeOptions{
+		Authenticator: auth,
+		Subprotocols:  []string{"tough.v2", "tough.v1"},
+	})
+
+	_, status := dialStatus(t, wsUrl(server), http.Header{"Authorization": []string{"Bearer wrong"}})
+	require.Equal(http.StatusUnauthorized, status)
+
+	header := http.Header{"Authorization": []string{"Bearer secret"}}
+	client, status := dialStatus(t, wsUrl(server), header, "tough.v1", "tough.v2")
+	require.Equal(http.StatusSwitchingProtocols, status)
+	require.Equal("tough.v2", client.Subprotocol(), "server preference is ignored")
+	conn := <-conns
+	require.Equal("agent-1", conn.Principal().Name)
+
+	_, status = dialStatus(t, wsUrl(server), header, "tough.v3")
+	require.Equal(http.StatusBadRequest, status, "unsupported subprotocol was accepted")
+}
+
+func TestBearerAuthenticatorWrapsLookupErrors(t *testing.T) {
+	auth := BearerAuthenticator(func(ctx context.Context, token string) (Principal, error) {
+		return Principal{}, errors.New("unknown token")
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	_, err := auth.Authenticate(r)
+	requirement.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestUpgradeHandlerChecksOrigin(t *testing.T) {
+	require := requirement.New(t)
+	server, _ := newUpgradeServer(t, UpgradeOptions{AllowedOrigins: []string{"https://app.example"}})
+
+	_, status := dialStatus(t, wsUrl(server), http.Header{"Origin": []string{"https://evil.example"}})
+	require.Equal(http.StatusForbidden, status)
+	_, status = dialStatus(t, wsUrl(server), http.Header{"Origin": []string{"https://app.example"}})
+	require.Equal(http.StatusSwitchingProtocols, status)
+}
+
+func TestHMACQueryAuthenticator(t *testing.T) {
+	require := requirement.New(t)
+	secret := []byte("shared secret")
+	clock := NewFakeClock(time.Unix(1000, 0))
+	auth := HMACQueryAuthenticator{Secret: secret, Clock: clock}
+	query := SignQuery(secret, "agent-2", clock.Now().Add(time.Minute))
+	request := httptest.NewRequest(http.MethodGet, "/ws?"+query.Encode(), nil)
+
+	principal, err := auth.Authenticate(request)
+	require.NoError(err)
+	require.Equal("agent-2", principal.Name)
+
+	forged := SignQuery([]byte("other secret"), "agent-2", clock.Now().Add(time.Minute))
+	_, err = auth.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?"+forged.Encode(), nil))
+	require.ErrorIs(err, ErrUnauthenticated)
+
+	clock.Advance(time.Minute)
+	_, err = auth.Authenticate(request)
+	require.ErrorIs(err, ErrUnauthenticated, "expired signature was accepted")
+}
+
+func TestWSConnLabelsKeepPrincipalName(t *testing.T) {
+	principal := Principal{Name: "agent-1", Attributes: map[string]string{"principal": "admin", "role": "agent"}}
+	labels := NewAuthenticatedWSConn(nil, websocket.TextMessage, principal, logutil.DummyLogger).Labels()
+	requirement.Equal(t, Labels{"principal": "agent-1", "role": "agent"}, labels)
+}
@@ -0,0 +1,80 @@
+package source
+
+import (
+	"context"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	"github.com/gorilla/websocket"
+	requirement "github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newWSServer starts a ws server that reports handshake requests to requests
+// and sends every message it gets back
+func newWSServer(t *testing.T, requests chan *http.Request) *httptest.Server {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"tough.v2"},
+		CheckOrigin:  func(r *http.Request) bool { return true },
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests <- r
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if conn.WriteMessage(msgType, msg) != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func wsUrl(server *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWSOptionsAreUsedForHandshake(t *testing.T) {
+	require := requirement.New(t)
+	requests := make(chan *http.Request, 1)
+	server := newWSServer(t, requests)
+	defaultTimeout := websocket.DefaultDialer.HandshakeTimeout
+	ws := NewWSWithOptions(wsUrl(server), websocket.TextMessage, WSOptions{
+		RequestHeader: http.Header{"X-Token": []string{"secret"}},
+		Subprotocols:  []string{"tough.v1", "tough.v2"},
+		Origin:        "https://relay.example",
+	}, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(ws.Connect(ctx))
+	request := <-requests
+	require.Equal("secret", request.Header.Get("X-Token"))
+	require.Equal("https://relay.example", request.Header.Get("Origin"))
+	require.Equal("tough.v2", ws.Subprotocol())
+	require.Equal(defaultTimeout, websocket.DefaultDialer.HandshakeTimeout, "shared dialer was modified")
+}
+
+func TestWSMaxMessageSize(t *testing.T) {
+	require := requirement.New(t)
+	server := newWSServer(t, nil)
+	ws := NewWSWithOptions(wsUrl(server), websocket.TextMessage, WSOptions{MaxMessageSize: 8}, logutil.DummyLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(ws.Connect(ctx))
+
+	require.NoError(ws.Write([]byte("longer than eight bytes")))
+	err := ws.Consume(ctx)
+	require.Error(err, "message over the limit was read")
+}
@@ -0,0 +1,342 @@
+package tunneling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bifshteks/tough_common/pkg/tunneling/source"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// ForwardPermissions are the addresses (host:port) a user may forward. Patterns
+// are matched with path.Match, so "*" allows any address and "db.internal:*"
+// any port of the host.
+type ForwardPermissions struct {
+	// Local are the targets of direct-tcpip channels (ssh -L)
+	Local []string
+	// Remote are the addresses of tcpip-forward requests (ssh -R)
+	Remote []string
+}
+
+func forwardAllowed(patterns []string, addr string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, addr); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// SSHUser is an authenticated user of SSHServer
+type SSHUser struct {
+	// Principal names the user in labels of the sources, the ssh user name if empty
+	Principal   source.Principal
+	Permissions ForwardPermissions
+}
+
+// SSHAuthenticator checks the public key (or certificate) a user logs in with
+type SSHAuthenticator interface {
+	Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error)
+}
+
+// SSHAuthenticatorFunc is an adapter to use ordinary functions as SSHAuthenticator
+type SSHAuthenticatorFunc func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error)
+
+func (f SSHAuthenticatorFunc) Authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+	return f(conn, key)
+}
+
+type SSHServerOptions struct {
+	// HostKeys identify the server, e.g. parsed with ssh.ParsePrivateKey of pkg/ssh
+	HostKeys      []ssh.Signer
+	Authenticator SSHAuthenticator
+	// DialUnforwarded lets direct-tcpip channels reach targets nobody forwards
+	// with tcpip-forward, connecting to them as TCP sources
+	DialUnforwarded bool
+	// Transmitter configures the Transmitters bridging the channels
+	Transmitter TransmitterOptions
+}
+
+// SSHServer is an ssh server for relaying with plain `ssh -R` and `ssh -L`.
+// tcpip-forward requests are not bound to ports of the server: they register
+// the address for the user, and direct-tcpip channels of other users to that
+// address are bridged with a channel opened back to the registered user.
+// Every bridge is a Transmitter of the two channels, which stops when
+// either of them closes.
+type SSHServer struct {
+	options SSHServerOptions
+	config  *ssh.ServerConfig
+	logger  *logrus.Logger
+
+	mx sync.Mutex
+	// forwards are the users that registered the addresses
+	forwards map[string]forward
+}
+
+type forward struct {
+	conn *ssh.ServerConn
+	user SSHUser
+}
+
+func NewSSHServer(options SSHServerOptions, logger *logrus.Logger) (*SSHServer, error) {
+	if len(options.HostKeys) == 0 {
+		return nil, errors.New("ssh server needs a host key")
+	}
+	if options.Authenticator == nil {
+		return nil, errors.New("ssh server needs an authenticator")
+	}
+	server := &SSHServer{
+		options:  options,
+		logger:   logger,
+		forwards: make(map[string]forward),
+	}
+	server.config = &ssh.ServerConfig{PublicKeyCallback: server.authenticate}
+	for _, key := range options.HostKeys {
+		server.config.AddHostKey(key)
+	}
+	return server, nil
+}
+
+// userExtension is the extension of ssh.Permissions carrying the SSHUser
+const userExtension = "tough-common-user"
+
+// authenticate returns the user in the permissions, as ssh caches them with
+// the key: clients may query several keys before logging in with one of them,
+// so only the permissions of the connection tell which user it is
+func (server *SSHServer) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, err := server.options.Authenticator.Authenticate(conn, key)
+	if err != nil {
+		return nil, err
+	}
+	if user.Principal.Name == "" {
+		user.Principal.Name = conn.User()
+	}
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{userExtension: string(encoded)}}, nil
+}
+
+func connUser(conn *ssh.ServerConn) (user SSHUser, err error) {
+	if conn.Permissions == nil {
+		return user, errors.New("ssh connection has no permissions")
+	}
+	err = json.Unmarshal([]byte(conn.Permissions.Extensions[userExtension]), &user)
+	return user, err
+}
+
+// Serve accepts connections until ctx is done or the listener fails
+func (server *SSHServer) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go server.ServeConn(ctx, conn)
+	}
+}
+
+// ServeConn serves a single connection until the client disconnects or ctx is done
+func (server *SSHServer) ServeConn(ctx context.Context, conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		server.logger.Infof("ssh handshake with %s failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	user, err := connUser(sshConn)
+	if err != nil {
+		server.logger.Errorf("cannot tell the ssh user connected from %s: %s", conn.RemoteAddr(), err)
+		sshConn.Close()
+		return
+	}
+	server.logger.Infof("ssh user %s connected from %s", user.Principal.Name, conn.RemoteAddr())
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		sshConn.Close()
+	}()
+	go server.handleRequests(sshConn, user, requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip channels are supported")
+			continue
+		}
+		go server.handleDirect(connCtx, sshConn, user, newChannel)
+	}
+	server.unregister(sshConn)
+	server.logger.Infof("ssh user %s disconnected", user.Principal.Name)
+}
+
+type forwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+func (server *SSHServer) handleRequests(conn *ssh.ServerConn, user SSHUser, requests <-chan *ssh.Request) {
+	for request := range requests {
+		var ok bool
+		switch request.Type {
+		case "tcpip-forward":
+			ok = server.register(conn, user, request.Payload)
+		case "cancel-tcpip-forward":
+			ok = server.cancelForward(conn, request.Payload)
+		}
+		if request.WantReply {
+			_ = request.Reply(ok, nil)
+		}
+	}
+}
+
+func (server *SSHServer) register(conn *ssh.ServerConn, user SSHUser, payload []byte) bool {
+	var request forwardRequest
+	if err := ssh.Unmarshal(payload, &request); err != nil || request.BindPort == 0 {
+		// port 0 would ask us to choose a port, but there are no ports to choose from
+		return false
+	}
+	addr := net.JoinHostPort(request.BindAddr, strconv.Itoa(int(request.BindPort)))
+	if !forwardAllowed(user.Permissions.Remote, addr) {
+		server.logger.Infof("ssh user %s is not allowed to forward %s", user.Principal.Name, addr)
+		return false
+	}
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	if owner, taken := server.forwards[addr]; taken && owner.conn != conn {
+		server.logger.Infof("ssh user %s cannot forward %s, it is already forwarded", user.Principal.Name, addr)
+		return false
+	}
+	server.forwards[addr] = forward{conn: conn, user: user}
+	server.logger.Infof("ssh user %s forwards %s", user.Principal.Name, addr)
+	return true
+}
+
+func (server *SSHServer) cancelForward(conn *ssh.ServerConn, payload []byte) bool {
+	var request forwardRequest
+	if err := ssh.Unmarshal(payload, &request); err != nil {
+		return false
+	}
+	addr := net.JoinHostPort(request.BindAddr, strconv.Itoa(int(request.BindPort)))
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	if server.forwards[addr].conn != conn {
+		return false
+	}
+	delete(server.forwards, addr)
+	return true
+}
+
+// unregister removes all addresses forwarded by the connection
+func (server *SSHServer) unregister(conn *ssh.ServerConn) {
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	for addr, owner := range server.forwards {
+		if owner.conn == conn {
+			delete(server.forwards, addr)
+		}
+	}
+}
+
+func (server *SSHServer) forwarder(addr string) (forward, bool) {
+	server.mx.Lock()
+	defer server.mx.Unlock()
+	owner, ok := server.forwards[addr]
+	return owner, ok
+}
+
+// channelRequest is the payload of direct-tcpip channels and, with the address
+// forwarded instead of the target, of forwarded-tcpip channels
+type channelRequest struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+func (server *SSHServer) handleDirect(ctx context.Context, conn *ssh.ServerConn, user SSHUser, newChannel ssh.NewChannel) {
+	var request channelRequest
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &request); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+	target := net.JoinHostPort(request.Host, strconv.Itoa(int(request.Port)))
+	if !forwardAllowed(user.Permissions.Local, target) {
+		server.logger.Infof("ssh user %s is not allowed to connect to %s", user.Principal.Name, target)
+		_ = newChannel.Reject(ssh.Prohibited, "not allowed to connect to "+target)
+		return
+	}
+
+	// clients like x/crypto/ssh do not send their origin, but the forwarding
+	// clients may reject channels without it
+	if origin, ok := conn.RemoteAddr().(*net.TCPAddr); ok && request.OriginPort == 0 {
+		request.OriginHost, request.OriginPort = origin.IP.String(), uint32(origin.Port)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	peer, err := server.connectPeer(ctx, target, request)
+	if err != nil {
+		cancel()
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		cancel()
+		// cancel closes dialed tcp peers only, forwarded-tcpip channels must be closed
+		if closer, ok := peer.(interface{ Close() }); ok {
+			closer.Close()
+		}
+		server.logger.Errorf("cannot accept ssh channel to %s: %s", target, err)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	transmitter := NewTransmitterWithOptions(server.options.Transmitter, server.logger)
+	transmitter.AddSources(source.NewSSHChannel(channel, userLabels(user, target), server.logger), peer)
+	go transmitter.Run(ctx, cancel)
+}
+
+// connectPeer connects to the user forwarding target, or to target itself
+// if it may be dialed
+func (server *SSHServer) connectPeer(ctx context.Context, target string, request channelRequest) (source.Source, error) {
+	if owner, ok := server.forwarder(target); ok {
+		channel, requests, err := owner.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(request))
+		if err != nil {
+			return nil, fmt.Errorf("cannot reach %s: %w", target, err)
+		}
+		go ssh.DiscardRequests(requests)
+		return source.NewSSHChannel(channel, userLabels(owner.user, target), server.logger), nil
+	}
+	if !server.options.DialUnforwarded {
+		return nil, fmt.Errorf("%s is not forwarded", target)
+	}
+	tcp := source.NewTCP(target, server.logger)
+	if err := tcp.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return source.WithLabels(tcp, source.Labels{"target": target}), nil
+}
+
+// userLabels are the labels of channels of the user
+func userLabels(user SSHUser, target string) source.Labels {
+	labels := source.Labels{"target": target}
+	for key, value := range user.Principal.Attributes {
+		labels[key] = value
+	}
+	// set last, so that attributes cannot override it
+	labels["principal"] = user.Principal.Name
+	return labels
+}
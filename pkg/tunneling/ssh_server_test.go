@@ -0,0 +1,152 @@
+package tunneling
+
+import (
+	"context"
+	"errors"
+	"github.com/bifshteks/tough_common/pkg/logutil"
+	pkgssh "github.com/bifshteks/tough_common/pkg/ssh"
+	requirement "github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"testing"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	pair, err := pkgssh.GenerateKey(pkgssh.KeyOptions{})
+	requirement.NoError(t, err)
+	signer, err := pkgssh.ParsePrivateKey([]byte(pair.PrivatePEM), nil)
+	requirement.NoError(t, err)
+	return signer
+}
+
+// startSSHServer serves users (by the key they log in with) until the test ends
+func startSSHServer(t *testing.T, hostKey ssh.Signer, users map[string]SSHUser) string {
+	server, err := NewSSHServer(SSHServerOptions{
+		HostKeys: []ssh.Signer{hostKey},
+		Authenticator: SSHAuthenticatorFunc(func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			user, ok := users[pkgssh.FingerprintSHA256(key)]
+			if !ok {
+				return SSHUser{}, errors.New("unknown key")
+			}
+			return user, nil
+		}),
+	}, logutil.DummyLogger)
+	requirement.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	requirement.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = server.Serve(ctx, listener) }()
+	return listener.Addr().String()
+}
+
+func sshLogin(t *testing.T, addr string, hostKey ssh.Signer, user ssh.Signer) *ssh.Client {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "tunnel",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(user)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	requirement.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSSHServerBridgesLocalAndRemoteForwards(t *testing.T) {
+	require := requirement.New(t)
+	hostKey := newTestSigner(t)
+	backendKey, clientKey, intruderKey := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	const forwarded = "127.0.0.1:9000"
+	addr := startSSHServer(t, hostKey, map[string]SSHUser{
+		pkgssh.FingerprintSHA256(backendKey.PublicKey()):  {Permissions: ForwardPermissions{Remote: []string{forwarded}}},
+		pkgssh.FingerprintSHA256(clientKey.PublicKey()):   {Permissions: ForwardPermissions{Local: []string{"127.0.0.1:*"}}},
+		pkgssh.FingerprintSHA256(intruderKey.PublicKey()): {},
+	})
+
+	// backend does `ssh -R 127.0.0.1:9000:...` and echoes whatever comes through it
+	backend := sshLogin(t, addr, hostKey, backendKey)
+	_, err := backend.Listen("tcp", "127.0.0.1:9001")
+	require.Error(err, "forwarding of a not permitted address")
+	listener, err := backend.Listen("tcp", forwarded)
+	require.NoError(err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// client does `ssh -L ...:127.0.0.1:9000`
+	client := sshLogin(t, addr, hostKey, clientKey)
+	conn, err := client.Dial("tcp", forwarded)
+	require.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("through the relay"))
+	require.NoError(err)
+	reply := make([]byte, len("through the relay"))
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(err)
+	require.Equal("through the relay", string(reply))
+
+	_, err = client.Dial("tcp", "127.0.0.1:9002")
+	require.Error(err, "connected to an address nobody forwards")
+	intruder := sshLogin(t, addr, hostKey, intruderKey)
+	_, err = intruder.Dial("tcp", forwarded)
+	require.Error(err, "connected without permission")
+}
+
+func TestSSHServerRejectsUnknownKeys(t *testing.T) {
+	hostKey := newTestSigner(t)
+	addr := startSSHServer(t, hostKey, map[string]SSHUser{})
+	_, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "tunnel",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newTestSigner(t))},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	requirement.Error(t, err)
+}
+
+// connMetadata is the user of a connection being authenticated
+type connMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (conn connMetadata) User() string {
+	return conn.user
+}
+
+func TestSSHServerResolvesUserFromPermissionsOfTheKey(t *testing.T) {
+	require := requirement.New(t)
+	victimKey, intruderKey := newTestSigner(t), newTestSigner(t)
+	victim := SSHUser{Permissions: ForwardPermissions{Remote: []string{"127.0.0.1:9000"}}}
+	server, err := NewSSHServer(SSHServerOptions{
+		HostKeys: []ssh.Signer{newTestSigner(t)},
+		Authenticator: SSHAuthenticatorFunc(func(conn ssh.ConnMetadata, key ssh.PublicKey) (SSHUser, error) {
+			if pkgssh.FingerprintSHA256(key) == pkgssh.FingerprintSHA256(victimKey.PublicKey()) {
+				return victim, nil
+			}
+			return SSHUser{}, nil
+		}),
+	}, logutil.DummyLogger)
+	require.NoError(err)
+
+	// ssh caches the permissions of checked keys, so the intruder may log in with
+	// its key after the server was last asked about the key of the victim
+	meta := connMetadata{user: "tunnel"}
+	intruderPermissions, err := server.authenticate(meta, intruderKey.PublicKey())
+	require.NoError(err)
+	_, err = server.authenticate(meta, victimKey.PublicKey())
+	require.NoError(err)
+
+	user, err := connUser(&ssh.ServerConn{Permissions: intruderPermissions})
+	require.NoError(err)
+	require.Equal("tunnel", user.Principal.Name)
+	require.Empty(user.Permissions.Remote, "intruder got the permissions of the victim")
+}
@@ -2,9 +2,11 @@ package tunneling
 
 import (
 	"context"
+	"errors"
 	"github.com/bifshteks/tough_common/pkg/tunneling/source"
 	"github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 type Message struct {
@@ -17,8 +19,12 @@ type Pool struct {
 	sources []source.Source
 }
 
+// All returns a copy of the sources, so that they can be iterated while
+// sources are added and removed
 func (pool *Pool) All() (sources []source.Source) {
-	return pool.sources
+	pool.mx.Lock()
+	defer pool.mx.Unlock()
+	return append([]source.Source{}, pool.sources...)
 }
 
 func (pool *Pool) Add(sources ...source.Source) {
@@ -38,6 +44,7 @@ func (pool *Pool) findSourceIndex(source source.Source) (i int, exists bool) {
 
 func (pool *Pool) Remove(source source.Source) {
 	pool.mx.Lock()
+	defer pool.mx.Unlock()
 	i, exists := pool.findSourceIndex(source)
 	if !exists {
 		return
@@ -45,7 +52,23 @@ func (pool *Pool) Remove(source source.Source) {
 	lastIndex := len(pool.sources) - 1
 	pool.sources[i] = pool.sources[lastIndex]
 	pool.sources = pool.sources[:lastIndex]
-	pool.mx.Unlock()
+}
+
+// TransmitterOptions configure optional behaviour of Transmitter
+type TransmitterOptions struct {
+	// Policy decides which messages may pass between which sources, nil allows everything
+	Policy Policy
+	// Audit is called for every message (or delivery) denied by Policy. It is
+	// called concurrently from the goroutines reading and writing the sources,
+	// so it must be safe for concurrent use.
+	Audit func(record AuditRecord)
+	// RateLimits limit messages read from and written to sources
+	RateLimits RateLimits
+}
+
+type sourceLimiters struct {
+	inbound  *RateLimiter
+	outbound *RateLimiter
 }
 
 type Transmitter struct {
@@ -54,21 +77,31 @@ type Transmitter struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	messagesCh chan Message
+	options    TransmitterOptions
+	limitersMx sync.Mutex
+	limiters   map[source.Source]sourceLimiters
 	logger     *logrus.Logger
 }
 
 func NewTransmitter(logger *logrus.Logger) *Transmitter {
+	return NewTransmitterWithOptions(TransmitterOptions{}, logger)
+}
+
+func NewTransmitterWithOptions(options TransmitterOptions, logger *logrus.Logger) *Transmitter {
 	return &Transmitter{
 		pool: &Pool{
 			sources: make([]source.Source, 0),
 		},
 		messagesCh: make(chan Message),
+		options:    options,
+		limiters:   make(map[source.Source]sourceLimiters),
 		logger:     logger,
 	}
 }
 
 func (t *Transmitter) processSources(sources ...source.Source) {
 	for _, s := range sources {
+		t.addLimiters(s)
 		t.wg.Add(1)
 		go t.read(s)
 	}
@@ -119,10 +152,14 @@ func (t *Transmitter) read(source source.Source) {
 	for {
 		select {
 		case msg := <-reader:
+			if !t.admit(source, msg) || !t.limitInbound(source, msg) {
+				continue
+			}
 			t.messagesCh <- Message{content: msg, author: source}
 		case <-t.ctx.Done():
 			sourceReadWg.Wait()
 			t.pool.Remove(source)
+			t.removeLimiters(source)
 			t.wg.Done()
 			return
 		}
@@ -141,8 +178,103 @@ func (t *Transmitter) WriteToSources() {
 			if isAuthorOfMsg {
 				continue
 			}
-			// don't care if it ended with error - is not ours responsibility
-			_ = src.Write(msg.content)
+			if !t.route(msg, src) || !t.limitOutbound(src, msg.content) {
+				continue
+			}
+			// don't care if it ended with error - is not ours responsibility,
+			// unless the recipient refused the message for its size
+			if err := src.Write(msg.content); errors.Is(err, source.ErrMessageTooBig) {
+				t.deny(Decision{Reason: err.Error()}, msg.author, src, msg.content)
+			}
 		}
 	}
 }
+
+func (t *Transmitter) admit(author source.Source, msg []byte) bool {
+	if t.options.Policy == nil {
+		return true
+	}
+	decision := t.options.Policy.Admit(author, msg)
+	if !decision.Allowed {
+		t.deny(decision, author, nil, msg)
+	}
+	return decision.Allowed
+}
+
+func (t *Transmitter) route(msg Message, recipient source.Source) bool {
+	if t.options.Policy == nil {
+		return true
+	}
+	decision := t.options.Policy.Route(msg.author, recipient, msg.content)
+	if !decision.Allowed {
+		t.deny(decision, msg.author, recipient, msg.content)
+	}
+	return decision.Allowed
+}
+
+func (t *Transmitter) deny(decision Decision, author source.Source, recipient source.Source, msg []byte) {
+	record := AuditRecord{
+		Time:   time.Now(),
+		From:   source.LabelsOf(author),
+		Size:   len(msg),
+		Rule:   decision.Rule,
+		Reason: decision.Reason,
+	}
+	if recipient != nil {
+		record.To = source.LabelsOf(recipient)
+	}
+	t.logger.Debugf("transmitter denied message from %v to %v: %s", record.From, record.To, record.Reason)
+	if t.options.Audit != nil {
+		t.options.Audit(record)
+	}
+}
+
+func (t *Transmitter) addLimiters(src source.Source) {
+	limits := t.options.RateLimits
+	var limiters sourceLimiters
+	if limits.Inbound != nil {
+		limiters.inbound = limits.Inbound(src)
+	}
+	if limits.Outbound != nil {
+		limiters.outbound = limits.Outbound(src)
+	}
+	t.limitersMx.Lock()
+	t.limiters[src] = limiters
+	t.limitersMx.Unlock()
+}
+
+func (t *Transmitter) removeLimiters(src source.Source) {
+	t.limitersMx.Lock()
+	delete(t.limiters, src)
+	t.limitersMx.Unlock()
+}
+
+func (t *Transmitter) sourceLimiters(src source.Source) sourceLimiters {
+	t.limitersMx.Lock()
+	defer t.limitersMx.Unlock()
+	return t.limiters[src]
+}
+
+// limitInbound applies per source and total limits to a message read from author
+func (t *Transmitter) limitInbound(author source.Source, msg []byte) bool {
+	inbound := t.sourceLimiters(author).inbound
+	if inbound != nil && !inbound.Allow(t.ctx, len(msg)) {
+		t.logger.Debugf("transmitter dropped message of %d bytes over inbound limit", len(msg))
+		return false
+	}
+	total := t.options.RateLimits.Total
+	if total != nil && !total.Allow(t.ctx, len(msg)) {
+		t.logger.Debugf("transmitter dropped message of %d bytes over total limit", len(msg))
+		return false
+	}
+	return true
+}
+
+func (t *Transmitter) limitOutbound(recipient source.Source, msg []byte) bool {
+	outbound := t.sourceLimiters(recipient).outbound
+	if outbound != nil && !outbound.Allow(t.ctx, len(msg)) {
+		t.logger.Debugf("transmitter dropped message of %d bytes over outbound limit", len(msg))
+		return false
+	}
+	return true
+}
@@ -3,11 +3,14 @@ package tunneling
 import (
 	"context"
 	"errors"
+	"sync"
+	"testing"
 	"time"
 )
 
 type SourceMock struct {
 	out                        chan []byte
+	mx                         sync.Mutex // guards gotMsgs, written by the transmitter
 	gotMsgs                    []string
 	readMsgs                   []string
 	failsConsumeBeforeMessages bool
@@ -54,11 +57,13 @@ func (s *SourceMock) Consume(ctx context.Context) (err error) {
 	return nil
 }
 
-func (s SourceMock) GetReader() chan []byte {
+func (s *SourceMock) GetReader() chan []byte {
 	return s.out
 }
 
 func (s *SourceMock) Write(bytes []byte) (err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
 	s.gotMsgs = append(s.gotMsgs, string(bytes))
 	return nil
 }
@@ -71,11 +76,44 @@ func (s *SourceMock) GetUrl() (url string) {
 	return ""
 }
 
+func (s *SourceMock) messages() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]string(nil), s.gotMsgs...)
+}
+
 func (s *SourceMock) gotMessage(msg string) bool {
-	for _, m := range s.gotMsgs {
+	for _, m := range s.messages() {
 		if m == msg {
 			return true
 		}
 	}
 	return false
 }
+
+// waitForMessages waits until the source got the messages
+func waitForMessages(t *testing.T, s *SourceMock, msgs ...string) {
+	deadline := time.Now().Add(time.Second)
+	for _, msg := range msgs {
+		for !s.gotMessage(msg) {
+			if time.Now().After(deadline) {
+				t.Fatalf("source did not get %q, got %v", msg, s.messages())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// runTransmitter runs trans until stop is called, stop waits for Run to return
+func runTransmitter(trans *Transmitter) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		trans.Run(ctx, cancel)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}